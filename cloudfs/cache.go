@@ -0,0 +1,293 @@
+package cloudfs
+
+import (
+	"container/list"
+	"context"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gocloud.dev/blob"
+)
+
+//cachedFilePattern starts the name of every file of a Cache
+const cachedFilePattern = "cached"
+
+//DefaultCacheMaxBytes is the size of a Cache when none is specified
+var DefaultCacheMaxBytes int64 = 1 << 30
+
+var (
+	cacheHits      = expvar.NewInt("cloudfs_cache_hits")
+	cacheMisses    = expvar.NewInt("cloudfs_cache_misses")
+	cacheEvictions = expvar.NewInt("cloudfs_cache_evictions")
+	cacheBytes     = expvar.NewInt("cloudfs_cache_bytes")
+)
+
+//CacheStats is a snapshot of the cache counters
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Bytes     int64
+}
+
+//Stats returns the cache counters of every Cache in the process
+func Stats() CacheStats {
+	return CacheStats{
+		Hits:      cacheHits.Value(),
+		Misses:    cacheMisses.Value(),
+		Evictions: cacheEvictions.Value(),
+		Bytes:     cacheBytes.Value(),
+	}
+}
+
+//Cache is a local disk cache of blob contents, keyed by bucket, blob key and ETag, and limited in
+//size by evicting the least recently used entries. It is shared by every session of a server.
+//Blobs are downloaded in the background on a miss, the read that missed is served by the bucket.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu sync.Mutex
+	//used counts the entries, including the ones being read, and the downloads being filled
+	used    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	fills   map[string]*cacheFill
+}
+
+//cacheFill is a download of a blob into the cache, it has reserved size bytes
+type cacheFill struct {
+	bucket string
+	key    string
+	size   int64
+	//invalidated fills are discarded once downloaded
+	invalidated bool
+}
+
+type cacheEntry struct {
+	id string
+	//bucket identifies the bucket of key, keys of different buckets never share entries
+	bucket  string
+	key     string
+	path    string
+	size    int64
+	refs    int
+	removed bool
+}
+
+//NewCache creates a Cache that stores up to maxBytes of blob contents in dir. Entries don't survive
+//a restart, the ones left in dir by a previous Cache are removed.
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	if len(dir) == 0 {
+		dir = filepath.Join(os.TempDir(), "cloud-sftp-cache")
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultCacheMaxBytes
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, cachedFilePattern+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		os.Remove(path)
+	}
+
+	return &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		fills:    map[string]*cacheFill{},
+	}, nil
+}
+
+//cachedFile is an open reference to a cache entry
+type cachedFile struct {
+	*os.File
+	cache *Cache
+	entry *cacheEntry
+}
+
+//Close releases the reference to the cache entry
+func (f *cachedFile) Close() error {
+	err := f.File.Close()
+	f.cache.release(f.entry)
+	return err
+}
+
+//open returns the cached contents of the blob stored at key in b. bucket identifies b. On a miss it
+//starts downloading the blob in the background and returns nil, so the reads of the caller go to the
+//bucket. A blob that doesn't fit in the cache next to the entries being read is not downloaded.
+func (c *Cache) open(ctx context.Context, bucket string, b *blob.Bucket, key string) (*cachedFile, error) {
+	attrs, err := b.Attributes(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	id := bucket + "\x00" + key + "\x00" + BlobETag(attrs)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[id]; ok {
+		cacheHits.Add(1)
+		c.lru.MoveToFront(el)
+		return c.openEntry(el.Value.(*cacheEntry))
+	}
+
+	cacheMisses.Add(1)
+	if _, ok := c.fills[id]; ok || !c.reserve(attrs.Size) {
+		return nil, nil
+	}
+	fill := &cacheFill{bucket: bucket, key: key, size: attrs.Size}
+	c.fills[id] = fill
+	go c.fill(id, fill, b)
+	return nil, nil
+}
+
+//reserve must be called with c.mu held. It evicts least recently used entries that aren't being
+//read until size bytes fit in the cache, and reports whether they do.
+func (c *Cache) reserve(size int64) bool {
+	for el := c.lru.Back(); el != nil && c.used+size > c.maxBytes; {
+		prev := el.Prev()
+		if el.Value.(*cacheEntry).refs == 0 {
+			c.remove(el)
+			cacheEvictions.Add(1)
+		}
+		el = prev
+	}
+	if c.used+size > c.maxBytes {
+		return false
+	}
+	c.used += size
+	cacheBytes.Add(size)
+	return true
+}
+
+//fill downloads the blob of fill and adds it to the cache as id, its reservation is released if
+//it fails or was invalidated in the meantime
+func (c *Cache) fill(id string, fill *cacheFill, b *blob.Bucket) {
+	path, err := c.download(context.Background(), b, fill.key, fill.size)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.fills, id)
+	if err != nil || fill.invalidated {
+		c.used -= fill.size
+		cacheBytes.Add(-fill.size)
+		if err == nil {
+			os.Remove(path)
+		}
+		return
+	}
+	c.entries[id] = c.lru.PushFront(&cacheEntry{
+		id:     id,
+		bucket: fill.bucket,
+		key:    fill.key,
+		path:   path,
+		size:   fill.size,
+	})
+}
+
+//download copies the blob stored at key to a new file of the cache, it fails unless the blob is
+//size bytes long so a blob replaced while downloading never outgrows its reservation
+func (c *Cache) download(ctx context.Context, b *blob.Bucket, key string, size int64) (string, error) {
+	reader, err := b.NewReader(ctx, key, nil)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	file, err := ioutil.TempFile(c.dir, cachedFilePattern)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, io.LimitReader(reader, size+1))
+	if err == nil && n != size {
+		err = fmt.Errorf("%v changed while it was cached", key)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+//openEntry must be called with c.mu held
+func (c *Cache) openEntry(entry *cacheEntry) (*cachedFile, error) {
+	file, err := os.Open(entry.path)
+	if err != nil {
+		return nil, err
+	}
+	entry.refs++
+	return &cachedFile{
+		File:  file,
+		cache: c,
+		entry: entry,
+	}, nil
+}
+
+func (c *Cache) release(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.refs--
+	if entry.removed && entry.refs == 0 {
+		os.Remove(entry.path)
+	}
+}
+
+//remove must be called with c.mu held. The file of an entry that is still being read is
+//deleted once its last reference is released.
+func (c *Cache) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.id)
+	c.used -= entry.size
+	cacheBytes.Add(-entry.size)
+	entry.removed = true
+	if entry.refs == 0 {
+		os.Remove(entry.path)
+	}
+}
+
+//Invalidate removes every cached version of the blob stored at key in the bucket identified by bucket
+func (c *Cache) Invalidate(bucket string, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if entry := el.Value.(*cacheEntry); entry.bucket == bucket && entry.key == key {
+			c.remove(el)
+		}
+		el = next
+	}
+	for _, fill := range c.fills {
+		if fill.bucket == bucket && fill.key == key {
+			fill.invalidated = true
+		}
+	}
+}
+
+//BlobETag returns the ETag of a blob, or a stand in built from its size, modification time and MD5
+//for drivers that don't expose one
+func BlobETag(attrs *blob.Attributes) string {
+	var head s3.HeadObjectOutput
+	if attrs.As(&head) && head.ETag != nil {
+		return aws.StringValue(head.ETag)
+	}
+	return fmt.Sprintf("%d-%d-%s", attrs.Size, attrs.ModTime.UnixNano(), hex.EncodeToString(attrs.MD5))
+}
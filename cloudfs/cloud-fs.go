@@ -6,6 +6,9 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
@@ -18,15 +21,53 @@ var folderPlaceHolderContents = []byte("Place Holder")
 
 //CloudFs file-system-y thing that the Hanlders live on
 type CloudFs struct {
-	bucket *blob.Bucket
-	logger *logrus.Entry
+	mounts     []*mount
+	logger     *logrus.Entry
+	staging    *Staging
+	cache      *Cache
+	prefetcher *Prefetcher
+	spill      *Spill
+	upload     UploadOptions
+	authorizer Authorizer
+
+	openMu    sync.Mutex
+	openFiles map[string]*stagedFile
+	//uploads counts the files open for writing
+	uploads int32
+}
+
+//Options configures optional CloudFs behaviour
+type Options struct {
+	//Staging holds files opened for reading and writing. When nil such opens are rejected
+	Staging *Staging
+	//Cache serves repeated reads of the same blob from local disk. When nil reads always go to the bucket
+	Cache *Cache
+	//Prefetcher fetches ranges of large sequential downloads concurrently. When nil reads are fetched one at a time
+	Prefetcher *Prefetcher
+	//Spill buffers uploads written out of order on local disk. When nil they are buffered in the system temp dir
+	Spill *Spill
+	//Upload tunes how files are written to the bucket
+	Upload UploadOptions
+	//Authorizer decides which operations are allowed. When nil every operation is allowed
+	Authorizer Authorizer
+	//Mounts make up the file system instead of the single bucket passed to New
+	Mounts []Mount
+	//BucketID identifies the single bucket passed to New in Cache, as Mount.BucketID does for mounts
+	BucketID string
 }
 
-//New creates a CloudFs
-func New(bucket *blob.Bucket, logger *logrus.Entry) *CloudFs {
+//New creates a CloudFs serving bucket at the root, or the mounts in options when there are any
+func New(bucket *blob.Bucket, logger *logrus.Entry, options Options) *CloudFs {
 	return &CloudFs{
-		bucket: bucket,
-		logger: logger,
+		mounts:     newMounts(bucket, options.BucketID, options.Mounts),
+		logger:     logger,
+		staging:    options.Staging,
+		cache:      options.Cache,
+		prefetcher: options.Prefetcher,
+		spill:      options.Spill,
+		upload:     options.Upload,
+		authorizer: options.Authorizer,
+		openFiles:  map[string]*stagedFile{},
 	}
 }
 
@@ -35,11 +76,21 @@ func (fs *CloudFs) Fileread(req *sftp.Request) (io.ReaderAt, error) {
 	fs.logger.WithFields(log.Fields{
 		"path": req.Filepath,
 	}).Info("Beginning FileRead request")
+	if err := fs.authorize(PermRead, req.Filepath); err != nil {
+		return nil, err
+	}
+	m, err := fs.resolve("open", req.Filepath)
+	if err != nil {
+		return nil, err
+	}
 
 	return &remoteFile{
-		path:   req.Filepath,
-		bucket: fs.bucket,
-		ctx:    req.Context(),
+		path:       m.key(req.Filepath),
+		bucket:     m.bucket,
+		bucketID:   m.bucketID,
+		ctx:        req.Context(),
+		cache:      fs.cache,
+		prefetcher: fs.prefetcher,
 	}, nil
 }
 
@@ -48,7 +99,109 @@ func (fs *CloudFs) Filewrite(req *sftp.Request) (io.WriterAt, error) {
 	fs.logger.WithFields(log.Fields{
 		"path": req.Filepath,
 	}).Info("Beginning FileWrite request")
-	return newRemoteFileWriter(req.Context(), fs.bucket, req.Filepath)
+	m, err := fs.resolve("open", req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.authorizeWrite(req.Context(), m, req.Filepath); err != nil {
+		return nil, err
+	}
+	key := m.key(req.Filepath)
+	fs.invalidate(m, key)
+	w, err := newRemoteFileWriter(req.Context(), m.bucket, key, fs.spill, fs.upload)
+	if err != nil {
+		return nil, err
+	}
+	w.onDone = fs.startUpload()
+	return w, nil
+}
+
+//startUpload counts a file open for writing until the returned func is called
+func (fs *CloudFs) startUpload() func() {
+	atomic.AddInt32(&fs.uploads, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt32(&fs.uploads, -1)
+		})
+	}
+}
+
+//Uploads returns the number of files open for writing, which are lost if the session ends before
+//they are closed
+func (fs *CloudFs) Uploads() int {
+	return int(atomic.LoadInt32(&fs.uploads))
+}
+
+//OpenFile handles sftp requests that open a file for both reading and writing
+func (fs *CloudFs) OpenFile(req *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	logger := fs.logger.WithFields(log.Fields{
+		"path": req.Filepath,
+	})
+	logger.Info("Beginning OpenFile request")
+	if fs.staging == nil {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	m, err := fs.resolve("open", req.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.authorizeWrite(req.Context(), m, req.Filepath); err != nil {
+		return nil, err
+	}
+	//the handle can read back what it writes, but reading existing contents needs read permission
+	if !req.Pflags().Trunc {
+		if err := fs.authorize(PermRead, req.Filepath); err != nil {
+			return nil, err
+		}
+	}
+	key := m.key(req.Filepath)
+	fs.invalidate(m, key)
+
+	//a truncating open has nothing to download or patch, so it is streamed like any other upload
+	if req.Pflags().Trunc {
+		w, err := newRemoteFileWriter(req.Context(), m.bucket, key, fs.spill, fs.upload)
+		if err != nil {
+			return nil, err
+		}
+		w.onDone = fs.startUpload()
+		return &truncatedFile{w}, nil
+	}
+
+	fs.openMu.Lock()
+	defer fs.openMu.Unlock()
+	if _, ok := fs.openFiles[req.Filepath]; ok {
+		return nil, errors.New("File is already open for writing")
+	}
+
+	f, err := newStagedFile(req.Context(), m.bucket, key, fs.staging, fs.upload)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
+	fs.openFiles[req.Filepath] = f
+	f.onClose = func() {
+		fs.openMu.Lock()
+		defer fs.openMu.Unlock()
+		delete(fs.openFiles, req.Filepath)
+	}
+	f.onDone = fs.startUpload()
+	return f, nil
+}
+
+//invalidate drops cached contents of key in the bucket of m, it is called before key is modified
+func (fs *CloudFs) invalidate(m *mount, key string) {
+	if fs.cache != nil {
+		fs.cache.Invalidate(m.bucketID, key)
+	}
+}
+
+//openFile returns the staged file open at p, if any
+func (fs *CloudFs) openFile(p string) *stagedFile {
+	fs.openMu.Lock()
+	defer fs.openMu.Unlock()
+	return fs.openFiles[p]
 }
 
 //Filecmd handles sftp file cmd requests
@@ -61,34 +214,90 @@ func (fs *CloudFs) Filecmd(req *sftp.Request) error {
 	logger.Info("Beginning FileCommand request")
 	switch req.Method {
 	case "Setstat":
+		if req.AttrFlags().Size {
+			if err := fs.authorize(PermOverwrite, req.Filepath); err != nil {
+				return err
+			}
+			m, err := fs.resolve("setstat", req.Filepath)
+			if err != nil {
+				return err
+			}
+			size := int64(req.Attributes().Size)
+			if f := fs.openFile(req.Filepath); f != nil {
+				err = f.Truncate(size)
+			} else {
+				key := m.key(req.Filepath)
+				fs.invalidate(m, key)
+				err = truncate(req.Context(), m.bucket, key, size, fs.upload)
+			}
+			if err != nil {
+				logger.Error(err)
+				return errors.New("Truncate Failed")
+			}
+		}
 		return nil
-	case "Rename":
-		err := fs.bucket.Copy(req.Context(), req.Target, req.Filepath, nil)
+	case "Rename", "PosixRename":
+		if err := fs.authorize(PermRename, req.Filepath); err != nil {
+			return err
+		}
+		if err := fs.authorize(PermRename, req.Target); err != nil {
+			return err
+		}
+		if fs.isMountDir(req.Filepath) {
+			return &os.PathError{Op: "rename", Path: req.Filepath, Err: syscall.EPERM}
+		}
+		src, err := fs.resolve("rename", req.Filepath)
+		if err != nil {
+			return err
+		}
+		dst, err := fs.resolve("rename", req.Target)
+		if err != nil {
+			return err
+		}
+		if err := fs.authorizeOverwrite(req.Context(), dst, req.Target); err != nil {
+			return err
+		}
+		srcKey := src.key(req.Filepath)
+		dstKey := dst.key(req.Target)
+		fs.invalidate(src, srcKey)
+		fs.invalidate(dst, dstKey)
+		//mounts of different buckets can't copy server side
+		if src.bucket == dst.bucket {
+			err = dst.bucket.Copy(req.Context(), dstKey, srcKey, nil)
+		} else {
+			err = fs.copyBetween(req.Context(), dst, dstKey, src, srcKey)
+		}
 		if err != nil {
 			logger.Error(err)
 			return errors.New("Rename Failed")
 		}
-		err = fs.bucket.Delete(req.Context(), req.Filepath)
+		err = src.bucket.Delete(req.Context(), srcKey)
 		if err != nil {
 			logger.Error(err)
 			return errors.New("Rename Failed")
 		}
 		return nil
 	case "Rmdir":
-		prefix := ""
-		if req.Filepath != "/" {
-			prefix = strings.TrimPrefix(req.Filepath, "/")
-			if !strings.HasSuffix(prefix, "/") {
-				prefix = prefix + "/"
-			}
-			logger.Debug(prefix)
+		if err := fs.authorize(PermRmdir, req.Filepath); err != nil {
+			return err
 		}
+		if fs.isMountDir(req.Filepath) {
+			return &os.PathError{Op: "rmdir", Path: req.Filepath, Err: syscall.EPERM}
+		}
+		m, err := fs.resolve("rmdir", req.Filepath)
+		if err != nil {
+			return err
+		}
+		prefix := m.listPrefix(req.Filepath)
+		logger.Debug(prefix)
 
 		listOptions := &blob.ListOptions{
 			Prefix:    prefix,
 			Delimiter: "/",
 		}
-		iter := fs.bucket.List(listOptions)
+		//only empty directories are removed, removing the files in one takes PermDelete for each of them
+		placeholders := []string{}
+		iter := m.bucket.List(listOptions)
 		for {
 			obj, err := iter.Next(req.Context())
 
@@ -101,19 +310,41 @@ func (fs *CloudFs) Filecmd(req *sftp.Request) error {
 				return err
 			}
 
-			err = fs.bucket.Delete(req.Context(), obj.Key)
+			if obj.IsDir || path.Base(obj.Key) != folderPlaceHolderName {
+				return &os.PathError{Op: "rmdir", Path: req.Filepath, Err: syscall.ENOTEMPTY}
+			}
+			placeholders = append(placeholders, obj.Key)
+		}
+		for _, key := range placeholders {
+			err = m.bucket.Delete(req.Context(), key)
 			if err != nil {
-				return errors.New("Failed to delete file: " + obj.Key)
+				return errors.New("Failed to delete file: " + key)
 			}
 		}
 	case "Remove":
-		err := fs.bucket.Delete(req.Context(), req.Filepath)
+		if err := fs.authorize(PermDelete, req.Filepath); err != nil {
+			return err
+		}
+		m, err := fs.resolve("remove", req.Filepath)
+		if err != nil {
+			return err
+		}
+		key := m.key(req.Filepath)
+		fs.invalidate(m, key)
+		err = m.bucket.Delete(req.Context(), key)
 		if err != nil {
 			logger.Error(err)
 			return errors.New("Remove Failed")
 		}
 	case "Mkdir":
-		return fs.bucket.WriteAll(req.Context(), path.Join(req.Filepath, folderPlaceHolderName), folderPlaceHolderContents, nil)
+		if err := fs.authorize(PermMkdir, req.Filepath); err != nil {
+			return err
+		}
+		m, err := fs.resolve("mkdir", req.Filepath)
+		if err != nil {
+			return err
+		}
+		return m.bucket.WriteAll(req.Context(), path.Join(m.key(req.Filepath), folderPlaceHolderName), folderPlaceHolderContents, nil)
 	case "Link":
 		return errors.New("SymLinks not supported")
 	case "Symlink":
@@ -131,70 +362,110 @@ func (fs *CloudFs) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
 	logger.Info("Beginning FileList request")
 	switch req.Method {
 	case "List":
-		prefix := ""
-		if req.Filepath != "/" {
-			prefix = strings.TrimPrefix(req.Filepath, "/")
-			if !strings.HasSuffix(prefix, "/") {
-				prefix = prefix + "/"
-			}
-			logger.Debug(prefix)
+		if err := fs.authorize(PermList, req.Filepath); err != nil {
+			return nil, err
 		}
-		iter := fs.bucket.List(&blob.ListOptions{
-			Prefix:    prefix,
-			Delimiter: "/",
-		})
 
 		listObjects := []os.FileInfo{}
-		for {
-			obj, err := iter.Next(req.Context())
+		names := map[string]bool{}
+		m, err := fs.resolve("list", req.Filepath)
+		if m != nil {
+			prefix := m.listPrefix(req.Filepath)
+			logger.Debug(prefix)
+			iter := m.bucket.List(&blob.ListOptions{
+				Prefix:    prefix,
+				Delimiter: "/",
+			})
 
-			if err == io.EOF {
-				break
-			}
+			for {
+				obj, err := iter.Next(req.Context())
 
-			if err != nil {
-				logger.Error(err)
-				return nil, err
+				if err == io.EOF {
+					break
+				}
+
+				if err != nil {
+					logger.Error(err)
+					return nil, err
+				}
+
+				if strings.HasSuffix(obj.Key, folderPlaceHolderName) {
+					continue
+				}
+				logger.Debug("ListResult: " + obj.Key)
+				key := m.filePath(obj.Key)
+				names[path.Base(key)] = true
+				listObjects = append(listObjects, &blobFileInfo{
+					key:     key,
+					modTime: obj.ModTime,
+					size:    obj.Size,
+					md5:     obj.MD5,
+					isDir:   obj.IsDir,
+				})
 			}
+		} else if !fs.isMountDir(req.Filepath) {
+			return nil, err
+		}
 
-			if strings.HasSuffix(obj.Key, folderPlaceHolderName) {
+		//mount points show up as directories of their parent
+		for _, name := range fs.mountDirs(req.Filepath) {
+			if names[name] {
 				continue
 			}
-			logger.Debug("ListResult: " + obj.Key)
-			key := obj.Key
-			if !strings.HasPrefix(key, "/") {
-				key = "/" + obj.Key
-			}
 			listObjects = append(listObjects, &blobFileInfo{
-				key:     key,
-				modTime: obj.ModTime,
-				size:    obj.Size,
-				md5:     obj.MD5,
-				isDir:   obj.IsDir,
+				key:   path.Join(req.Filepath, name),
+				isDir: true,
 			})
 		}
 
 		return listerat(listObjects), nil
 	case "Stat":
+		m, err := fs.resolve("stat", req.Filepath)
+		if err != nil {
+			if fs.isMountDir(req.Filepath) {
+				return listerat([]os.FileInfo{&blobFileInfo{
+					key:   req.Filepath,
+					isDir: true,
+				}}), nil
+			}
+			return nil, err
+		}
+
+		//directories can always be stated so clients can change into them, files need list or read.
+		//The permissions are checked before looking the file up, a file that may not be stated fails
+		//like a missing one so its name doesn't leak.
+		statFile := fs.authorizer == nil || fs.authorizer.Allowed(PermList, req.Filepath) || fs.authorizer.Allowed(PermRead, req.Filepath)
+
 		file := &remoteFile{
-			bucket: fs.bucket,
-			path:   req.Filepath,
+			bucket: m.bucket,
+			path:   m.key(req.Filepath),
 			ctx:    req.Context(),
 		}
 
-		attrs, err := file.Attributes()
-		if err != nil {
-			logger.Error(err)
+		var attrs *blob.Attributes
+		if statFile {
+			attrs, err = file.Attributes()
+			if err != nil {
+				logger.Error(err)
+			}
+		}
+		if !statFile || err != nil {
 			ext := path.Ext(req.Filepath)
 			if len(ext) == 0 {
 				file = &remoteFile{
-					bucket: fs.bucket,
-					path:   path.Join(req.Filepath, folderPlaceHolderName),
+					bucket: m.bucket,
+					path:   path.Join(m.key(req.Filepath), folderPlaceHolderName),
 					ctx:    req.Context(),
 				}
 
 				attrs, err := file.Attributes()
 				if err != nil {
+					if fs.isMountDir(req.Filepath) {
+						return listerat([]os.FileInfo{&blobFileInfo{
+							key:   req.Filepath,
+							isDir: true,
+						}}), nil
+					}
 					return nil, errors.New("stat failed")
 				}
 
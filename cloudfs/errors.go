@@ -0,0 +1,20 @@
+package cloudfs
+
+import (
+	"os"
+	"syscall"
+
+	"gocloud.dev/gcerrors"
+)
+
+//statusError maps an error from the bucket to one the sftp server reports with a matching status
+//code. Errors without a better status are returned as is, so the client sees the real cause.
+func statusError(op string, key string, err error) error {
+	switch gcerrors.Code(err) {
+	case gcerrors.NotFound:
+		return &os.PathError{Op: op, Path: key, Err: syscall.ENOENT}
+	case gcerrors.PermissionDenied:
+		return &os.PathError{Op: op, Path: key, Err: syscall.EPERM}
+	}
+	return err
+}
@@ -0,0 +1,200 @@
+package cloudfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"gocloud.dev/blob"
+)
+
+//Mount places a bucket, or a prefix of one, at a path of the file system
+type Mount struct {
+	//Path is where the mount appears, such as /archive
+	Path string
+	//Bucket may be shared by several mounts and sessions, it is not closed by the file system
+	Bucket *blob.Bucket
+	//Prefix is prepended to the keys of the files in the mount, such as partnerA/
+	Prefix string
+	//BucketID identifies Bucket in the read cache shared by every session, mounts of the same bucket
+	//share cached contents. A mount without one only shares them with mounts of the same file system.
+	BucketID string
+}
+
+type mount struct {
+	path   string
+	bucket *blob.Bucket
+	//bucketID keys the cached contents of the mount's blobs
+	bucketID string
+	prefix   string
+	//rooted mounts keep the leading slash of keys, as a file system with a single bucket always has
+	rooted bool
+}
+
+//bucketIDs numbers the buckets that were given no id
+var bucketIDs uint64
+
+//anonymousBucketID returns an id no other bucket has
+func anonymousBucketID() string {
+	return fmt.Sprintf("\x00%v", atomic.AddUint64(&bucketIDs, 1))
+}
+
+func newMounts(bucket *blob.Bucket, bucketID string, mounts []Mount) []*mount {
+	if len(mounts) == 0 {
+		if len(bucketID) == 0 {
+			bucketID = anonymousBucketID()
+		}
+		return []*mount{{
+			path:     "/",
+			bucket:   bucket,
+			bucketID: bucketID,
+			rooted:   true,
+		}}
+	}
+
+	ms := make([]*mount, 0, len(mounts))
+	anonymous := map[*blob.Bucket]string{}
+	for _, m := range mounts {
+		id := m.BucketID
+		if len(id) == 0 {
+			if _, ok := anonymous[m.Bucket]; !ok {
+				anonymous[m.Bucket] = anonymousBucketID()
+			}
+			id = anonymous[m.Bucket]
+		}
+		prefix := strings.TrimPrefix(m.Prefix, "/")
+		if len(prefix) != 0 && !strings.HasSuffix(prefix, "/") {
+			prefix = prefix + "/"
+		}
+		ms = append(ms, &mount{
+			path:     path.Clean("/" + m.Path),
+			bucket:   m.Bucket,
+			bucketID: id,
+			prefix:   prefix,
+		})
+	}
+	//the deepest mount holding a path wins
+	sort.Slice(ms, func(i, j int) bool {
+		return len(ms[i].path) > len(ms[j].path)
+	})
+	return ms
+}
+
+//contains reports whether p is the mount point or below it
+func (m *mount) contains(p string) bool {
+	return m.path == "/" || p == m.path || strings.HasPrefix(p, m.path+"/")
+}
+
+//key returns the key of the blob holding p
+func (m *mount) key(p string) string {
+	if m.rooted {
+		return p
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, m.path), "/")
+	return m.prefix + rel
+}
+
+//listPrefix returns the prefix of the keys of the blobs in directory p
+func (m *mount) listPrefix(p string) string {
+	if m.rooted {
+		if p == "/" {
+			return ""
+		}
+		prefix := strings.TrimPrefix(p, "/")
+		if !strings.HasSuffix(prefix, "/") {
+			prefix = prefix + "/"
+		}
+		return prefix
+	}
+	rel := strings.Trim(strings.TrimPrefix(p, m.path), "/")
+	if len(rel) == 0 {
+		return m.prefix
+	}
+	return m.prefix + rel + "/"
+}
+
+//filePath returns the path of the blob stored at key
+func (m *mount) filePath(key string) string {
+	if m.rooted {
+		if !strings.HasPrefix(key, "/") {
+			key = "/" + key
+		}
+		return key
+	}
+	return path.Join(m.path, strings.TrimPrefix(key, m.prefix))
+}
+
+//resolve returns the mount holding p, or an error when p is outside every mount
+func (fs *CloudFs) resolve(op string, p string) (*mount, error) {
+	for _, m := range fs.mounts {
+		if m.contains(p) {
+			return m, nil
+		}
+	}
+	return nil, &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+}
+
+//isMountDir reports whether p is a mount point, or a directory leading to one. These directories
+//exist even when no blob is stored under them, and can't be removed or renamed.
+func (fs *CloudFs) isMountDir(p string) bool {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for _, m := range fs.mounts {
+		if m.rooted {
+			continue
+		}
+		if m.path == p || strings.HasPrefix(m.path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//mountDirs returns the names of the directories in p that lead to mount points
+func (fs *CloudFs) mountDirs(p string) []string {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	names := []string{}
+	seen := map[string]bool{}
+	for _, m := range fs.mounts {
+		if m.path == "/" || !strings.HasPrefix(m.path, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(m.path, prefix), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+//copyBetween copies a blob to another bucket by streaming it through the server
+func (fs *CloudFs) copyBetween(ctx context.Context, dst *mount, dstKey string, src *mount, srcKey string) error {
+	reader, err := src.bucket.NewReader(ctx, srcKey, nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer, err := dst.bucket.NewWriter(ctx, dstKey, fs.upload.writerOptions(&blob.WriterOptions{
+		ContentType: reader.ContentType(),
+	}))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		cancel()
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,134 @@
+package cloudfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+//Permissions is a set of operations a user may perform
+type Permissions uint
+
+const (
+	//PermList allows listing directories and stating files
+	PermList Permissions = 1 << iota
+	//PermRead allows downloading files
+	PermRead
+	//PermWrite allows uploading new files
+	PermWrite
+	//PermOverwrite allows replacing, truncating or patching existing files
+	PermOverwrite
+	//PermRename allows renaming files
+	PermRename
+	//PermDelete allows removing files
+	PermDelete
+	//PermMkdir allows creating directories
+	PermMkdir
+	//PermRmdir allows removing directories
+	PermRmdir
+)
+
+//AllPermissions allows every operation
+const AllPermissions = PermList | PermRead | PermWrite | PermOverwrite | PermRename | PermDelete | PermMkdir | PermRmdir
+
+var permissionNames = []struct {
+	name string
+	perm Permissions
+}{
+	{"list", PermList},
+	{"read", PermRead},
+	{"write", PermWrite},
+	{"overwrite", PermOverwrite},
+	{"rename", PermRename},
+	{"delete", PermDelete},
+	{"mkdir", PermMkdir},
+	{"rmdir", PermRmdir},
+}
+
+//ParsePermissions parses permission names, such as "read" or "write". "*" stands for every permission.
+func ParsePermissions(names []string) (Permissions, error) {
+	var p Permissions
+	for _, name := range names {
+		perm, err := parsePermission(name)
+		if err != nil {
+			return 0, err
+		}
+		p |= perm
+	}
+	return p, nil
+}
+
+func parsePermission(name string) (Permissions, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "*" || name == "all" {
+		return AllPermissions, nil
+	}
+	for _, n := range permissionNames {
+		if n.name == name {
+			return n.perm, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown permission %q", name)
+}
+
+//Has reports whether every permission in perm is in p
+func (p Permissions) Has(perm Permissions) bool {
+	return p&perm == perm
+}
+
+//Allowed implements Authorizer, the same permissions apply to every path
+func (p Permissions) Allowed(perm Permissions, path string) bool {
+	return p.Has(perm)
+}
+
+func (p Permissions) String() string {
+	if p == AllPermissions {
+		return "*"
+	}
+	names := []string{}
+	for _, n := range permissionNames {
+		if p.Has(n.perm) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+//Authorizer decides whether a user may perform an operation on a path
+type Authorizer interface {
+	Allowed(perm Permissions, path string) bool
+}
+
+//authorize returns a permission denied error unless perm is allowed on p
+func (fs *CloudFs) authorize(perm Permissions, p string) error {
+	if fs.authorizer == nil || fs.authorizer.Allowed(perm, p) {
+		return nil
+	}
+	fs.logger.WithField("path", p).Warnf("Denied %v", perm)
+	return &os.PathError{Op: perm.String(), Path: p, Err: syscall.EPERM}
+}
+
+//authorizeWrite checks that a file may be written, which requires overwrite when it already exists
+func (fs *CloudFs) authorizeWrite(ctx context.Context, m *mount, p string) error {
+	if err := fs.authorize(PermWrite, p); err != nil {
+		return err
+	}
+	return fs.authorizeOverwrite(ctx, m, p)
+}
+
+//authorizeOverwrite checks that p may be replaced if it already exists
+func (fs *CloudFs) authorizeOverwrite(ctx context.Context, m *mount, p string) error {
+	if fs.authorizer == nil || fs.authorizer.Allowed(PermOverwrite, p) {
+		return nil
+	}
+	exists, err := m.bucket.Exists(ctx, m.key(p))
+	if err != nil {
+		return statusError("write", p, err)
+	}
+	if exists {
+		return fs.authorize(PermOverwrite, p)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package cloudfs
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"gocloud.dev/blob"
+)
+
+//DefaultPrefetchChunkSize is the size of each range fetched ahead of a sequential reader
+var DefaultPrefetchChunkSize int64 = 8 << 20
+
+//DefaultPrefetchPerFile is the number of ranges fetched concurrently for one file
+var DefaultPrefetchPerFile = 4
+
+//DefaultPrefetchTotal is the number of ranges fetched concurrently across every file
+var DefaultPrefetchTotal = 32
+
+//DefaultPrefetchMaxMemory bounds the memory holding prefetched ranges across every file
+var DefaultPrefetchMaxMemory int64 = 256 << 20
+
+//DefaultPrefetchMinSize is the size a blob must have before its reads are prefetched
+var DefaultPrefetchMinSize int64 = 64 << 20
+
+//sequentialReadsBeforePrefetch is how many sequential reads of a file start a prefetch
+var sequentialReadsBeforePrefetch = 4
+
+//Prefetcher fetches upcoming ranges of large, sequentially read blobs concurrently. It bounds
+//the number of concurrent range requests and the memory they use across every session of a server.
+type Prefetcher struct {
+	chunkSize int64
+	perFile   int
+	minSize   int64
+	maxMemory int64
+	slots     chan struct{}
+
+	mu   sync.Mutex
+	used int64
+}
+
+//NewPrefetcher creates a Prefetcher. Zero values are replaced by the package defaults.
+func NewPrefetcher(chunkSize int64, perFile int, total int, maxMemory int64, minSize int64) *Prefetcher {
+	if chunkSize <= 0 {
+		chunkSize = DefaultPrefetchChunkSize
+	}
+	if perFile <= 0 {
+		perFile = DefaultPrefetchPerFile
+	}
+	if total <= 0 {
+		total = DefaultPrefetchTotal
+	}
+	if maxMemory <= 0 {
+		maxMemory = DefaultPrefetchMaxMemory
+	}
+	if minSize <= 0 {
+		minSize = DefaultPrefetchMinSize
+	}
+
+	return &Prefetcher{
+		chunkSize: chunkSize,
+		perFile:   perFile,
+		minSize:   minSize,
+		maxMemory: maxMemory,
+		slots:     make(chan struct{}, total),
+	}
+}
+
+func (p *Prefetcher) reserve(n int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.used+n > p.maxMemory {
+		return false
+	}
+	p.used += n
+	return true
+}
+
+func (p *Prefetcher) release(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used -= n
+}
+
+type prefetchChunk struct {
+	done    chan struct{}
+	size    int64
+	data    []byte
+	err     error
+	dropped bool
+}
+
+//filePrefetch holds the ranges fetched ahead of the reader of one blob
+type filePrefetch struct {
+	p      *Prefetcher
+	ctx    context.Context
+	cancel context.CancelFunc
+	bucket *blob.Bucket
+	key    string
+	size   int64
+
+	mu     sync.Mutex
+	chunks map[int64]*prefetchChunk
+	//first is the lowest chunk still prefetched, the ones below it were dropped and aren't fetched again
+	first int64
+}
+
+func newFilePrefetch(ctx context.Context, p *Prefetcher, b *blob.Bucket, key string, size int64) *filePrefetch {
+	ctx, cancel := context.WithCancel(ctx)
+	return &filePrefetch{
+		p:      p,
+		ctx:    ctx,
+		cancel: cancel,
+		bucket: b,
+		key:    key,
+		size:   size,
+		chunks: map[int64]*prefetchChunk{},
+	}
+}
+
+//readAt serves a read from the prefetched ranges. ok is false when the range could not be
+//prefetched, or the prefetch was closed while waiting for it, in which case the caller reads it
+//from the bucket itself.
+func (fp *filePrefetch) readAt(p []byte, off int64) (n int, ok bool, err error) {
+	cs := fp.p.chunkSize
+	idx := off / cs
+
+	fp.mu.Lock()
+	//a late read behind the reader is served directly rather than fetching its whole range again
+	if idx < fp.first {
+		fp.mu.Unlock()
+		return 0, false, nil
+	}
+	for i, c := range fp.chunks {
+		if i < idx {
+			fp.drop(i, c)
+		}
+	}
+	fp.first = idx
+	for i := idx; i < idx+int64(fp.p.perFile) && i*cs < fp.size; i++ {
+		if _, ok := fp.chunks[i]; ok {
+			continue
+		}
+		size := cs
+		if remaining := fp.size - i*cs; remaining < size {
+			size = remaining
+		}
+		if !fp.p.reserve(size) {
+			break
+		}
+		c := &prefetchChunk{
+			done: make(chan struct{}),
+			size: size,
+		}
+		fp.chunks[i] = c
+		go fp.fetch(i, c)
+	}
+	c, ok := fp.chunks[idx]
+	fp.mu.Unlock()
+
+	if !ok {
+		return 0, false, nil
+	}
+
+	select {
+	case <-c.done:
+	case <-fp.ctx.Done():
+		return 0, false, nil
+	}
+	if c.err != nil {
+		//a range cut short by closing the prefetch didn't fail
+		if fp.ctx.Err() != nil {
+			return 0, false, nil
+		}
+		return 0, true, c.err
+	}
+
+	start := off - idx*cs
+	if start >= int64(len(c.data)) {
+		return 0, true, io.EOF
+	}
+	//a read spanning two ranges returns short, the client asks for the rest
+	n = copy(p, c.data[start:])
+	if n < len(p) && off+int64(n) >= fp.size {
+		return n, true, io.EOF
+	}
+	return n, true, nil
+}
+
+func (fp *filePrefetch) fetch(i int64, c *prefetchChunk) {
+	defer func() {
+		close(c.done)
+		fp.mu.Lock()
+		defer fp.mu.Unlock()
+		if c.dropped {
+			fp.p.release(c.size)
+		}
+	}()
+
+	select {
+	case fp.p.slots <- struct{}{}:
+	case <-fp.ctx.Done():
+		c.err = fp.ctx.Err()
+		return
+	}
+	defer func() { <-fp.p.slots }()
+
+	r, err := fp.bucket.NewRangeReader(fp.ctx, fp.key, i*fp.p.chunkSize, c.size, nil)
+	if err != nil {
+		c.err = err
+		return
+	}
+	defer r.Close()
+
+	data := make([]byte, c.size)
+	n, err := io.ReadFull(r, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		c.err = err
+		return
+	}
+	c.data = data[:n]
+}
+
+//drop forgets chunk i, must be called with fp.mu held. The memory of a chunk that is still being
+//fetched is released when the fetch finishes.
+func (fp *filePrefetch) drop(i int64, c *prefetchChunk) {
+	delete(fp.chunks, i)
+	select {
+	case <-c.done:
+		fp.p.release(c.size)
+	default:
+		c.dropped = true
+	}
+}
+
+func (fp *filePrefetch) close() {
+	fp.cancel()
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	for i, c := range fp.chunks {
+		fp.drop(i, c)
+	}
+}
@@ -0,0 +1,306 @@
+package cloudfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/eikenb/pipeat"
+	"gocloud.dev/blob"
+)
+
+var defaultChunkSize = 32768
+
+var errRewrite = errors.New("Data that was already uploaded can't be written again")
+
+//remoteFileWriter streams an upload to the bucket. Writes arriving in order are written to the blob
+//directly, writes arriving ahead of it are held in memory until the gap is filled. When they don't fit
+//in the reorder window of the Spill the rest of the upload is buffered through a pipe on local disk.
+type remoteFileWriter struct {
+	key    string
+	writer *blob.Writer
+	out    io.Writer
+	flush  func() error
+	cancel context.CancelFunc
+	spill  *Spill
+
+	mu           sync.Mutex
+	next         int64
+	held         map[int64][]byte
+	heldBytes    int
+	readerAt     *pipeat.PipeReaderAt
+	writerAt     *pipeat.PipeWriterAt
+	spillBase    int64
+	reserved     int64
+	pumped       chan struct{}
+	uploadErr    error
+	readerClosed bool
+
+	//onDone is called once Close has finished or aborted the upload
+	onDone func()
+}
+
+func newRemoteFileWriter(ctx context.Context, b *blob.Bucket, key string, spill *Spill, upload UploadOptions) (*remoteFileWriter, error) {
+	if spill == nil {
+		spill = defaultSpill
+	}
+
+	//cancelling the writer's context aborts the upload instead of committing what was written so far
+	ctx, cancel := context.WithCancel(ctx)
+	writer, err := b.NewWriter(ctx, key, upload.writerOptions(nil))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	out, flush := upload.buffer(writer)
+
+	return &remoteFileWriter{
+		key:    key,
+		writer: writer,
+		out:    out,
+		flush:  flush,
+		cancel: cancel,
+		spill:  spill,
+		held:   map[int64][]byte{},
+	}, nil
+}
+
+func (w *remoteFileWriter) WriteAt(p []byte, off int64) (int, error) {
+	fmt.Printf("Write At off: %v, len: %v\n", off, len(p))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.uploadErr != nil {
+		return 0, statusError("write", w.key, w.uploadErr)
+	}
+
+	var err error
+	switch {
+	case w.writerAt != nil:
+		err = w.writeSpilled(p, off)
+	case off == w.next:
+		err = w.writeNext(p)
+	case off < w.next:
+		err = errRewrite
+	case w.heldBytes+len(p) <= w.spill.window:
+		w.hold(p, off)
+	default:
+		err = w.startSpill()
+		if err == nil {
+			err = w.writeSpilled(p, off)
+		}
+	}
+
+	if err != nil {
+		w.failLocked(err)
+		return 0, statusError("write", w.key, w.uploadErr)
+	}
+	return len(p), nil
+}
+
+//writeNext writes p to the blob followed by any held writes it makes contiguous, must be called with w.mu held
+func (w *remoteFileWriter) writeNext(p []byte) error {
+	if _, err := w.out.Write(p); err != nil {
+		return err
+	}
+	w.next += int64(len(p))
+
+	for {
+		data, ok := w.held[w.next]
+		if !ok {
+			return nil
+		}
+		delete(w.held, w.next)
+		w.heldBytes -= len(data)
+		if _, err := w.out.Write(data); err != nil {
+			return err
+		}
+		w.next += int64(len(data))
+	}
+}
+
+//hold keeps a copy of a write that arrived ahead of the blob, must be called with w.mu held
+func (w *remoteFileWriter) hold(p []byte, off int64) {
+	if data, ok := w.held[off]; ok {
+		w.heldBytes -= len(data)
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	w.held[off] = data
+	w.heldBytes += len(data)
+}
+
+//flushHeld writes every held write to the blob, leaving zero bytes in any gap between them, must be
+//called with w.mu held
+func (w *remoteFileWriter) flushHeld() error {
+	for len(w.held) > 0 {
+		first := int64(-1)
+		for off := range w.held {
+			if first < 0 || off < first {
+				first = off
+			}
+		}
+		if first < w.next {
+			return errRewrite
+		}
+
+		if _, err := io.CopyN(w.out, zeroReader{}, first-w.next); err != nil {
+			return err
+		}
+		w.next = first
+		if err := w.writeNext(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//startSpill moves the held writes and the rest of the upload to a pipe on local disk, which is
+//streamed to the blob as the gaps in it are filled. Must be called with w.mu held.
+func (w *remoteFileWriter) startSpill() error {
+	readerAt, writerAt, err := w.spill.pipe()
+	if err != nil {
+		return err
+	}
+	w.readerAt = readerAt
+	w.writerAt = writerAt
+	w.spillBase = w.next
+	w.pumped = make(chan struct{})
+	go w.pump()
+
+	for off, data := range w.held {
+		if err := w.writeSpilled(data, off); err != nil {
+			return err
+		}
+	}
+	w.held = nil
+	w.heldBytes = 0
+	return nil
+}
+
+//writeSpilled must be called with w.mu held
+func (w *remoteFileWriter) writeSpilled(p []byte, off int64) error {
+	if off < w.spillBase {
+		return errRewrite
+	}
+
+	end := off + int64(len(p)) - w.spillBase
+	if end > w.reserved {
+		if err := w.spill.reserve(end - w.reserved); err != nil {
+			return err
+		}
+		w.reserved = end
+	}
+
+	_, err := w.writerAt.WriteAt(p, off-w.spillBase)
+	return err
+}
+
+//pump streams the spilled part of the upload to the blob
+func (w *remoteFileWriter) pump() {
+	defer close(w.pumped)
+	for {
+		p := make([]byte, defaultChunkSize)
+		bytesRead, err := w.readerAt.Read(p)
+		if err == nil || err == io.EOF {
+			_, writeErr := w.out.Write(p[:bytesRead])
+			if writeErr != nil {
+				w.fail(writeErr)
+				return
+			}
+		}
+
+		if err != nil && err != io.EOF {
+			w.fail(err)
+			return
+		}
+
+		if err == io.EOF {
+			w.mu.Lock()
+			w.closeReader(nil)
+			w.mu.Unlock()
+			return
+		}
+	}
+}
+
+//fail records the first error of the upload and aborts it, so the client's next WriteAt fails with
+//it rather than sending data that can never be stored
+func (w *remoteFileWriter) fail(err error) {
+	//a write blocked on the bucket holds the lock, cancelling first unblocks it
+	w.cancel()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failLocked(err)
+}
+
+//failLocked must be called with w.mu held
+func (w *remoteFileWriter) failLocked(err error) {
+	if w.uploadErr != nil {
+		return
+	}
+	w.uploadErr = err
+	w.cancel()
+	if w.readerAt != nil {
+		w.closeReader(err)
+	}
+}
+
+//closeReader closes the reading end of the pipe once, must be called with w.mu held
+func (w *remoteFileWriter) closeReader(err error) {
+	if w.readerClosed {
+		return
+	}
+	w.readerClosed = true
+	w.readerAt.CloseWithError(err)
+}
+
+//TransferError is called when the session ends with the file still open, the upload is aborted
+func (w *remoteFileWriter) TransferError(err error) {
+	w.fail(err)
+}
+
+func (w *remoteFileWriter) Close() error {
+	defer w.cancel()
+	if w.onDone != nil {
+		defer w.onDone()
+	}
+
+	w.mu.Lock()
+	if w.uploadErr == nil && w.writerAt == nil {
+		if err := w.flushHeld(); err != nil {
+			w.failLocked(err)
+		}
+	}
+	writerAt := w.writerAt
+	w.mu.Unlock()
+
+	if writerAt != nil {
+		writerAt.Close()
+		<-w.pumped
+		w.spill.release(w.reserved)
+	}
+
+	w.mu.Lock()
+	if w.uploadErr == nil {
+		if err := w.flush(); err != nil {
+			w.failLocked(err)
+		}
+	}
+	w.mu.Unlock()
+
+	writerErr := w.writer.Close()
+
+	w.mu.Lock()
+	uploadErr := w.uploadErr
+	w.mu.Unlock()
+	if uploadErr != nil {
+		return statusError("upload", w.key, uploadErr)
+	}
+	if writerErr != nil {
+		return errors.New("Failed to upload file")
+	}
+	return nil
+}
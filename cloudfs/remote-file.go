@@ -2,68 +2,47 @@ package cloudfs
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"io"
+	"sync"
 
-	"github.com/eikenb/pipeat"
 	"gocloud.dev/blob"
 )
 
 type remoteFile struct {
-	path   string
-	ctx    context.Context
-	bucket *blob.Bucket
-}
-
-type remoteFileWriter struct {
-	readerAt *pipeat.PipeReaderAt
-	writerAt *pipeat.PipeWriterAt
-	writer   *blob.Writer
-}
-
-func newRemoteFileWriter(ctx context.Context, b *blob.Bucket, key string) (*remoteFileWriter, error) {
-	readerAt, writerAt, err := pipeat.Pipe()
-	if err != nil {
-		return nil, err
-	}
+	path       string
+	ctx        context.Context
+	bucket     *blob.Bucket
+	bucketID   string
+	cache      *Cache
+	prefetcher *Prefetcher
 
-	writer, err := b.NewWriter(ctx, key, nil)
-	if err != nil {
-		return nil, err
-	}
+	cacheOnce sync.Once
+	cached    *cachedFile
 
-	go func() {
-		defer readerAt.Close()
-		for {
-			p := make([]byte, defaultChunkSize)
-			bytesRead, err := readerAt.Read(p)
-			if err == nil || err == io.EOF {
-				_, writeErr := writer.Write(p[:bytesRead])
-				if writeErr != nil {
-					break
-				}
-			}
-
-			if err != nil && err != io.EOF {
-				break
-			}
-
-			if err == io.EOF {
-				break
-			}
-		}
-	}()
-
-	return &remoteFileWriter{
-		writer:   writer,
-		readerAt: readerAt,
-		writerAt: writerAt,
-	}, nil
+	mu              sync.Mutex
+	size            int64
+	nextOff         int64
+	sequentialReads int
+	prefetch        *filePrefetch
 }
 
 func (f *remoteFile) ReadAt(p []byte, off int64) (int, error) {
 	fmt.Printf("Read At off: %v, len: %v\n", off, len(p))
+	if f.cache != nil {
+		f.cacheOnce.Do(func() {
+			//a failure to use the cache is not fatal, reads fall back to the bucket
+			f.cached, _ = f.cache.open(f.ctx, f.bucketID, f.bucket, f.path)
+		})
+		if f.cached != nil {
+			return f.cached.ReadAt(p, off)
+		}
+	}
+	if fp := f.prefetchFor(off, len(p)); fp != nil {
+		n, ok, err := fp.readAt(p, off)
+		if ok {
+			return n, err
+		}
+	}
 	r, err := f.bucket.NewRangeReader(f.ctx, f.path, off, int64(len(p)), nil)
 	if err != nil {
 		return 0, err
@@ -72,23 +51,63 @@ func (f *remoteFile) ReadAt(p []byte, off int64) (int, error) {
 	return r.Read(p)
 }
 
-var defaultChunkSize = 32768
+//prefetchFor tracks the read pattern of the file. It returns the prefetch for reads that are part
+//of a large sequential download, starting one if needed, and nil for any other read.
+func (f *remoteFile) prefetchFor(off int64, length int) *filePrefetch {
+	if f.prefetcher == nil {
+		return nil
+	}
 
-func (w *remoteFileWriter) WriteAt(p []byte, off int64) (int, error) {
-	fmt.Printf("Write At off: %v, len: %v\n", off, len(p))
-	i, err := w.writerAt.WriteAt(p, off)
-	if err != nil {
-		return i, err
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	//reads are served concurrently, so they may arrive slightly out of order
+	window := f.prefetcher.chunkSize
+	sequential := off >= f.nextOff-window && off <= f.nextOff+window
+	if end := off + int64(length); end > f.nextOff || !sequential {
+		f.nextOff = end
+	}
+
+	if !sequential {
+		f.sequentialReads = 0
+		if f.prefetch != nil {
+			f.prefetch.close()
+			f.prefetch = nil
+		}
+		return nil
+	}
+
+	f.sequentialReads++
+	if f.prefetch != nil || f.sequentialReads < sequentialReadsBeforePrefetch {
+		return f.prefetch
 	}
-	return i, nil
+
+	if f.size == 0 {
+		attrs, err := f.Attributes()
+		if err != nil {
+			return nil
+		}
+		f.size = attrs.Size
+	}
+	if f.size < f.prefetcher.minSize {
+		return nil
+	}
+
+	f.prefetch = newFilePrefetch(f.ctx, f.prefetcher, f.bucket, f.path, f.size)
+	return f.prefetch
 }
 
-func (w *remoteFileWriter) Close() error {
-	writerAtErr := w.writerAt.Close()
-	w.writerAt.WaitForReader()
-	writerErr := w.writer.Close()
-	if writerAtErr != nil || writerErr != nil {
-		return errors.New("Failed to upload file")
+//Close releases the cache entry the file was read from and any prefetched ranges
+func (f *remoteFile) Close() error {
+	f.mu.Lock()
+	if f.prefetch != nil {
+		f.prefetch.close()
+		f.prefetch = nil
+	}
+	f.mu.Unlock()
+
+	if f.cached != nil {
+		return f.cached.Close()
 	}
 	return nil
 }
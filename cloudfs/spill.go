@@ -0,0 +1,82 @@
+package cloudfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/eikenb/pipeat"
+)
+
+//DefaultSpillMaxBytes is the disk space available to spilled uploads when none is specified
+var DefaultSpillMaxBytes int64 = 1 << 30
+
+//DefaultReorderWindow is the memory an upload may use to hold writes that arrive ahead of the
+//data the bucket is waiting for
+var DefaultReorderWindow = 4 << 20
+
+var errSpillFull = errors.New("Not enough disk space to buffer out of order writes")
+
+//Spill is where uploads whose writes arrive too far out of order are buffered on local disk before
+//being streamed to the bucket. It bounds the disk space used across every session of a server.
+type Spill struct {
+	dir      string
+	maxBytes int64
+	window   int
+
+	mu   sync.Mutex
+	used int64
+}
+
+//NewSpill creates a Spill that buffers up to maxBytes of out of order uploads in dir, each upload
+//holding up to window bytes in memory before spilling. Zero values are replaced by the package defaults.
+func NewSpill(dir string, maxBytes int64, window int) (*Spill, error) {
+	if len(dir) == 0 {
+		dir = filepath.Join(os.TempDir(), "cloud-sftp-spill")
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultSpillMaxBytes
+	}
+	if window <= 0 {
+		window = DefaultReorderWindow
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Spill{
+		dir:      dir,
+		maxBytes: maxBytes,
+		window:   window,
+	}, nil
+}
+
+//defaultSpill is used by file systems created without a Spill, it buffers in the system temp dir
+var defaultSpill = &Spill{
+	maxBytes: DefaultSpillMaxBytes,
+	window:   DefaultReorderWindow,
+}
+
+func (s *Spill) reserve(n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used+n > s.maxBytes {
+		return errSpillFull
+	}
+	s.used += n
+	return nil
+}
+
+func (s *Spill) release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= n
+}
+
+func (s *Spill) pipe() (*pipeat.PipeReaderAt, *pipeat.PipeWriterAt, error) {
+	//writes to the pipe must never wait for the upload, they are made with the writer's lock held
+	return pipeat.AsyncWriterPipeInDir(s.dir)
+}
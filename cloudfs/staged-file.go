@@ -0,0 +1,254 @@
+package cloudfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+//stagedFile is a read-write file handle. Reads are served from the bucket until the first write,
+//which downloads the blob into the Staging area. From then on reads and writes go to the local
+//copy, and the blob is uploaded again when the handle is closed.
+type stagedFile struct {
+	ctx     context.Context
+	bucket  *blob.Bucket
+	key     string
+	staging *Staging
+	options UploadOptions
+	onClose func()
+	//onDone is called once Close has uploaded the file or failed to
+	onDone func()
+
+	mu       sync.Mutex
+	file     *os.File
+	reserved int64
+	size     int64
+	dirty    bool
+	closed   bool
+}
+
+func newStagedFile(ctx context.Context, b *blob.Bucket, key string, staging *Staging, upload UploadOptions) (*stagedFile, error) {
+	f := &stagedFile{
+		ctx:     ctx,
+		bucket:  b,
+		key:     key,
+		staging: staging,
+		options: upload,
+	}
+
+	exists, err := b.Exists(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	//a new file has nothing to download, stage it straight away so Close creates it
+	if !exists {
+		if err := f.stage(false); err != nil {
+			return nil, err
+		}
+		f.dirty = true
+	}
+
+	return f, nil
+}
+
+//stage creates the local copy of the file, downloading the current contents of the blob if download is set
+func (f *stagedFile) stage(download bool) error {
+	if err := f.staging.acquire(); err != nil {
+		return err
+	}
+
+	file, err := f.staging.tempFile()
+	if err != nil {
+		f.staging.releaseSlot()
+		return err
+	}
+	f.file = file
+
+	if download {
+		err = f.download()
+		if err != nil {
+			f.discard()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *stagedFile) download() error {
+	attrs, err := f.bucket.Attributes(f.ctx, f.key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+		return err
+	}
+
+	if err := f.grow(attrs.Size); err != nil {
+		return err
+	}
+
+	reader, err := f.bucket.NewReader(f.ctx, f.key, nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	n, err := io.Copy(f.file, reader)
+	f.size = n
+	return err
+}
+
+//grow extends the disk reservation of the file to cover size bytes
+func (f *stagedFile) grow(size int64) error {
+	if size <= f.reserved {
+		return nil
+	}
+	if err := f.staging.reserve(size - f.reserved); err != nil {
+		return err
+	}
+	f.reserved = size
+	return nil
+}
+
+//discard removes the local copy and returns its slot and disk reservation to the Staging area
+func (f *stagedFile) discard() {
+	if f.file == nil {
+		return
+	}
+	f.file.Close()
+	os.Remove(f.file.Name())
+	f.file = nil
+	f.staging.release(f.reserved)
+	f.reserved = 0
+	f.staging.releaseSlot()
+}
+
+func (f *stagedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		remote := &remoteFile{
+			path:   f.key,
+			bucket: f.bucket,
+			ctx:    f.ctx,
+		}
+		return remote.ReadAt(p, off)
+	}
+
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if remaining := f.size - off; int64(len(p)) > remaining {
+		n, err := f.file.ReadAt(p[:remaining], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *stagedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.stage(true); err != nil {
+			return 0, err
+		}
+	}
+
+	end := off + int64(len(p))
+	if err := f.grow(end); err != nil {
+		return 0, err
+	}
+
+	n, err := f.file.WriteAt(p, off)
+	f.dirty = true
+	if end := off + int64(n); end > f.size {
+		f.size = end
+	}
+	return n, err
+}
+
+//Truncate changes the size of the local copy, staging the file first if needed
+func (f *stagedFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.stage(true); err != nil {
+			return err
+		}
+	}
+
+	if err := f.grow(size); err != nil {
+		return err
+	}
+
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	f.size = size
+	f.dirty = true
+	return nil
+}
+
+func (f *stagedFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if f.onClose != nil {
+		f.onClose()
+	}
+	if f.onDone != nil {
+		defer f.onDone()
+	}
+	defer f.discard()
+
+	if !f.dirty {
+		return nil
+	}
+	return f.upload()
+}
+
+func (f *stagedFile) upload() error {
+	ctx, cancel := context.WithCancel(f.ctx)
+	defer cancel()
+
+	writer, err := f.bucket.NewWriter(ctx, f.key, f.options.writerOptions(nil))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, io.NewSectionReader(f.file, 0, f.size))
+	if err != nil {
+		cancel()
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+//truncatedFile is the handle for a read-write open that truncates the file. The upload is streamed
+//through a remoteFileWriter, so the contents can't be read back until the handle is closed.
+type truncatedFile struct {
+	*remoteFileWriter
+}
+
+func (f *truncatedFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("File was opened with truncate and can't be read until it is closed")
+}
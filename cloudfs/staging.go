@@ -0,0 +1,90 @@
+package cloudfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//DefaultStagingMaxBytes is the disk budget used by a Staging area when none is specified
+var DefaultStagingMaxBytes int64 = 1 << 30
+
+//DefaultStagingMaxFiles is the number of files that can be staged concurrently when no limit is specified
+var DefaultStagingMaxFiles = 16
+
+var errStagingFull = errors.New("Local staging area is full")
+var errStagingBusy = errors.New("Too many files are open for reading and writing")
+
+//Staging is a bounded area of local disk that holds files opened for random access writes until
+//they are uploaded. It is shared by every session of a server.
+type Staging struct {
+	dir      string
+	maxBytes int64
+	slots    chan struct{}
+
+	mu   sync.Mutex
+	used int64
+}
+
+//NewStaging creates a Staging area in dir. maxBytes bounds the disk space used by all staged
+//files and maxFiles bounds how many files can be staged at the same time.
+func NewStaging(dir string, maxBytes int64, maxFiles int) (*Staging, error) {
+	if len(dir) == 0 {
+		dir = filepath.Join(os.TempDir(), "cloud-sftp-staging")
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultStagingMaxBytes
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultStagingMaxFiles
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Staging{
+		dir:      dir,
+		maxBytes: maxBytes,
+		slots:    make(chan struct{}, maxFiles),
+	}, nil
+}
+
+//acquire claims one of the staging slots, it fails rather than blocking when all slots are in use
+func (s *Staging) acquire() error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+		return errStagingBusy
+	}
+}
+
+func (s *Staging) releaseSlot() {
+	<-s.slots
+}
+
+//reserve claims n bytes of the disk budget
+func (s *Staging) reserve(n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used+n > s.maxBytes {
+		return errStagingFull
+	}
+	s.used += n
+	return nil
+}
+
+//release returns n bytes to the disk budget
+func (s *Staging) release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= n
+}
+
+func (s *Staging) tempFile() (*os.File, error) {
+	return ioutil.TempFile(s.dir, "staged")
+}
@@ -0,0 +1,220 @@
+package cloudfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+//s3MinPartSize and s3MaxPartSize bound the parts of an S3 multipart upload, every part but the last
+//must be at least s3MinPartSize
+const (
+	s3MinPartSize = 5 << 20
+	s3MaxPartSize = 5 << 30
+)
+
+//zeroReader is an io.Reader that produces an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (z zeroReader) ReadAt(p []byte, off int64) (int, error) {
+	return z.Read(p)
+}
+
+//truncate changes the size of the blob stored at key. Shrinking rewrites the blob as a prefix of
+//itself, growing pads the existing contents with zero bytes. The new contents are only visible
+//once the rewrite has completed, readers never observe a partially truncated blob. On S3 the kept
+//contents are copied server side, other drivers stream them through the server.
+func truncate(ctx context.Context, b *blob.Bucket, key string, size int64, upload UploadOptions) error {
+	attrs, err := b.Attributes(ctx, key)
+	if err != nil {
+		//some clients send a truncate to zero before every overwrite, even for new files
+		if gcerrors.Code(err) == gcerrors.NotFound && size == 0 {
+			return nil
+		}
+		return err
+	}
+
+	if attrs.Size == size {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	//the S3 driver hands over the request of its upload, which the range copy reuses
+	var input *s3manager.UploadInput
+	opts := upload.writerOptions(&blob.WriterOptions{
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentType:        attrs.ContentType,
+		Metadata:           attrs.Metadata,
+	})
+	beforeWrite := opts.BeforeWrite
+	opts.BeforeWrite = func(as func(interface{}) bool) error {
+		as(&input)
+		if beforeWrite != nil {
+			return beforeWrite(as)
+		}
+		return nil
+	}
+	writer, err := b.NewWriter(ctx, key, opts)
+	if err != nil {
+		return err
+	}
+
+	var client *s3.S3
+	if input != nil && b.As(&client) && canCopyRange(attrs.Size, size) {
+		err = copyRange(ctx, client, input, attrs.Size, size)
+		//the writer was only needed for its request, closing it after cancelling writes nothing
+		cancel()
+		writer.Close()
+		return err
+	}
+
+	//fallback for drivers without a server side range copy, the kept prefix is downloaded and
+	//uploaded again
+	err = copyTruncated(ctx, b, writer, key, attrs.Size, size)
+	if err != nil {
+		//cancelling the context before Close aborts the write and leaves the original blob in place
+		cancel()
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+func copyTruncated(ctx context.Context, b *blob.Bucket, w io.Writer, key string, currentSize int64, size int64) error {
+	prefixSize := size
+	if currentSize < prefixSize {
+		prefixSize = currentSize
+	}
+
+	if prefixSize > 0 {
+		reader, err := b.NewRangeReader(ctx, key, 0, prefixSize, nil)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		if _, err := io.CopyN(w, reader, prefixSize); err != nil {
+			return err
+		}
+	}
+
+	if size > prefixSize {
+		if _, err := io.CopyN(w, zeroReader{}, size-prefixSize); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//canCopyRange reports whether copyRange can truncate a blob of currentSize to size. Nothing needs
+//copying when no bytes are kept, and a kept prefix followed by zero bytes can't be a part shorter
+//than s3MinPartSize.
+func canCopyRange(currentSize int64, size int64) bool {
+	prefixSize := size
+	if currentSize < prefixSize {
+		prefixSize = currentSize
+	}
+	return prefixSize > 0 && (prefixSize == size || prefixSize >= s3MinPartSize)
+}
+
+//copyRange rewrites the blob uploaded by input as a multipart upload. Its kept prefix is copied
+//server side with UploadPartCopy and any growth is uploaded as parts of zero bytes.
+func copyRange(ctx context.Context, client *s3.S3, input *s3manager.UploadInput, currentSize int64, size int64) error {
+	create := &s3.CreateMultipartUploadInput{}
+	awsutil.Copy(create, input)
+	created, err := client.CreateMultipartUploadWithContext(ctx, create)
+	if err != nil {
+		return err
+	}
+
+	var parts []*s3.CompletedPart
+	err = func() error {
+		prefixSize := size
+		if currentSize < prefixSize {
+			prefixSize = currentSize
+		}
+		source := (&url.URL{Path: aws.StringValue(input.Bucket) + "/" + aws.StringValue(input.Key)}).EscapedPath()
+
+		//parts of equal size keep the last copied part above the minimum when zero bytes follow it
+		count := (prefixSize + s3MaxPartSize - 1) / s3MaxPartSize
+		partSize := (prefixSize + count - 1) / count
+		for offset := int64(0); offset < prefixSize; offset += partSize {
+			end := offset + partSize
+			if end > prefixSize {
+				end = prefixSize
+			}
+			copyPart := &s3.UploadPartCopyInput{}
+			awsutil.Copy(copyPart, input)
+			copyPart.UploadId = created.UploadId
+			copyPart.PartNumber = aws.Int64(int64(len(parts) + 1))
+			copyPart.CopySource = aws.String(source)
+			copyPart.CopySourceRange = aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1))
+			copied, err := client.UploadPartCopyWithContext(ctx, copyPart)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, &s3.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: copyPart.PartNumber})
+		}
+
+		for offset := prefixSize; offset < size; offset += s3MaxPartSize {
+			n := size - offset
+			if n > s3MaxPartSize {
+				n = s3MaxPartSize
+			}
+			part := &s3.UploadPartInput{}
+			awsutil.Copy(part, input)
+			part.UploadId = created.UploadId
+			part.PartNumber = aws.Int64(int64(len(parts) + 1))
+			part.Body = io.NewSectionReader(zeroReader{}, 0, n)
+			part.ContentLength = aws.Int64(n)
+			uploaded, err := client.UploadPartWithContext(ctx, part)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, &s3.CompletedPart{ETag: uploaded.ETag, PartNumber: part.PartNumber})
+		}
+		return nil
+	}()
+	if err == nil {
+		_, err = client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          input.Bucket,
+			Key:             input.Key,
+			UploadId:        created.UploadId,
+			RequestPayer:    input.RequestPayer,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		//the blob keeps its original contents until the upload completes
+		client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:       input.Bucket,
+			Key:          input.Key,
+			UploadId:     created.UploadId,
+			RequestPayer: input.RequestPayer,
+		})
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package cloudfs
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"gocloud.dev/blob"
+)
+
+//UploadOptions tunes how files are written to the bucket. Zero values keep the driver's defaults.
+type UploadOptions struct {
+	//BufferSize is the size of the buffer collecting client writes before they are handed to the bucket
+	BufferSize int
+	//PartSize is the size of each S3 part, Azure block or GCS chunk uploaded in a single request
+	PartSize int
+	//Concurrency is the number of Azure blocks uploaded in parallel. The S3 driver always uploads its
+	//default of 5 parts in parallel, and GCS uploads one chunk at a time.
+	Concurrency int
+}
+
+//Merge returns o with its zero values replaced by the ones in defaults
+func (o UploadOptions) Merge(defaults UploadOptions) UploadOptions {
+	if o.BufferSize == 0 {
+		o.BufferSize = defaults.BufferSize
+	}
+	if o.PartSize == 0 {
+		o.PartSize = defaults.PartSize
+	}
+	if o.Concurrency == 0 {
+		o.Concurrency = defaults.Concurrency
+	}
+	return o
+}
+
+//writerOptions applies the options to opts, which may be nil
+func (o UploadOptions) writerOptions(opts *blob.WriterOptions) *blob.WriterOptions {
+	if opts == nil {
+		opts = &blob.WriterOptions{}
+	}
+	if o.PartSize > 0 {
+		opts.BufferSize = o.PartSize
+	}
+	if o.Concurrency > 0 {
+		beforeWrite := opts.BeforeWrite
+		opts.BeforeWrite = func(as func(interface{}) bool) error {
+			var azureOpts *azblob.UploadStreamToBlockBlobOptions
+			if as(&azureOpts) {
+				azureOpts.MaxBuffers = o.Concurrency
+			}
+			if beforeWrite != nil {
+				return beforeWrite(as)
+			}
+			return nil
+		}
+	}
+	return opts
+}
+
+//buffer wraps w in a buffer of BufferSize, the returned flush must be called before w is closed
+func (o UploadOptions) buffer(w *blob.Writer) (io.Writer, func() error) {
+	if o.BufferSize <= 0 {
+		return w, func() error { return nil }
+	}
+	buffered := bufio.NewWriterSize(w, o.BufferSize)
+	return buffered, buffered.Flush
+}
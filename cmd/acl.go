@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/shidel-dev/cloud-sftp/cloudfs"
+	"github.com/shidel-dev/cloud-sftp/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var aclConfigSource string
+var aclUser string
+var aclPath string
+var aclOp string
+
+func init() {
+	rootCmd.AddCommand(aclCmd)
+	aclCmd.PersistentFlags().StringVarP(&aclConfigSource, "config-source", "c", "cloud-sftp-config.json", "json, yaml or toml file path or a blob url https://gocloud.dev/concepts/urls/")
+	aclCmd.AddCommand(aclTestCmd)
+
+	aclTestCmd.Flags().StringVar(&aclUser, "user", "", "username")
+	aclTestCmd.Flags().StringVar(&aclPath, "path", "", "path the operation is performed on")
+	aclTestCmd.Flags().StringVar(&aclOp, "op", "", "operation, one of list, read, write, overwrite, rename, delete, mkdir or rmdir")
+	aclTestCmd.MarkFlagRequired("user")
+	aclTestCmd.MarkFlagRequired("path")
+	aclTestCmd.MarkFlagRequired("op")
+}
+
+var aclCmd = &cobra.Command{
+	Use:   "acl",
+	Short: "Inspect access control rules",
+}
+
+var aclTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "explain whether a user may perform an operation on a path",
+	Run: func(cmd *cobra.Command, args []string) {
+		configProvider, err := config.ParseConfigSource(aclConfigSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		c, err := configProvider.ReadConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		perm, err := cloudfs.ParsePermissions([]string{aclOp})
+		if err != nil || perm == cloudfs.AllPermissions {
+			log.Fatalf("Invalid op %q", aclOp)
+		}
+
+		decision, err := config.Explain(c, aclUser, perm, aclPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if decision.Allowed {
+			fmt.Printf("allowed: %v\n", decision.Reason)
+			return
+		}
+		fmt.Printf("denied: %v\n", decision.Reason)
+		os.Exit(1)
+	},
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/shidel-dev/cloud-sftp/server"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var bansAdminAddr string
+var bansIP string
+var bansUser string
+
+func init() {
+	rootCmd.AddCommand(bansCmd)
+	bansCmd.PersistentFlags().StringVar(&bansAdminAddr, "admin-addr", "localhost:8080", "admin address of the running server")
+	bansCmd.AddCommand(listBansCmd)
+	bansCmd.AddCommand(clearBansCmd)
+
+	clearBansCmd.Flags().StringVar(&bansIP, "ip", "", "client ip to unban")
+	clearBansCmd.Flags().StringVar(&bansUser, "user", "", "username to unban")
+}
+
+var bansCmd = &cobra.Command{
+	Use:   "bans",
+	Short: "Manage the client ips and usernames banned after failed sign ins",
+}
+
+//bansURL returns the url of the bans of the admin server, limited to kind and value when set
+func bansURL(kind string, value string) string {
+	addr := bansAdminAddr
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u := strings.TrimSuffix(addr, "/") + "/bans"
+	if len(kind) != 0 {
+		u += "?" + url.Values{"kind": {kind}, "value": {value}}.Encode()
+	}
+	return u
+}
+
+func adminRequest(method string, u string) io.ReadCloser {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Admin server responded with %v", resp.Status)
+	}
+	return resp.Body
+}
+
+var listBansCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the bans in effect",
+	Run: func(cmd *cobra.Command, args []string) {
+		body := adminRequest(http.MethodGet, bansURL("", ""))
+		defer body.Close()
+
+		var bans []server.Ban
+		if err := json.NewDecoder(body).Decode(&bans); err != nil {
+			log.Fatal(err)
+		}
+		for _, ban := range bans {
+			fmt.Fprintf(os.Stdout, "%v\t%v\tuntil %v\t%v failures\n", ban.Kind, ban.Value, ban.Until.Format("2006-01-02 15:04:05"), ban.Failures)
+		}
+	},
+}
+
+var clearBansCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "lift the ban of a client ip or username, or every ban when neither is given",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(bansIP) != 0 && len(bansUser) != 0 {
+			log.Fatal("Only one of --ip and --user can be given")
+		}
+		kind, value := "", ""
+		if len(bansIP) != 0 {
+			kind, value = "ip", bansIP
+		}
+		if len(bansUser) != 0 {
+			kind, value = "user", bansUser
+		}
+
+		body := adminRequest(http.MethodDelete, bansURL(kind, value))
+		defer body.Close()
+
+		var result struct {
+			Cleared int `json:"cleared"`
+		}
+		if err := json.NewDecoder(body).Decode(&result); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("cleared %v bans\n", result.Cleared)
+	},
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/shidel-dev/cloud-sftp/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var configConfigSource string
+var configProbe bool
+var configOutput string
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.PersistentFlags().StringVarP(&configConfigSource, "config-source", "c", "cloud-sftp-config.json", "json, yaml or toml file path or a blob url https://gocloud.dev/concepts/urls/")
+	configCmd.AddCommand(validateConfigCmd)
+	configCmd.AddCommand(schemaConfigCmd)
+
+	validateConfigCmd.Flags().BoolVar(&configProbe, "probe", false, "also check that every bucket of the config can be listed")
+	validateConfigCmd.Flags().StringVarP(&configOutput, "output", "o", "text", "text or json")
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Check the config",
+}
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "report every problem of the config, exiting with 1 when there are any",
+	Run: func(cmd *cobra.Command, args []string) {
+		configProvider, err := config.ParseConfigSource(configConfigSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		problems, err := configProvider.Validate(configProbe)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		switch configOutput {
+		case "json":
+			if problems == nil {
+				problems = []config.Problem{}
+			}
+			e := json.NewEncoder(os.Stdout)
+			e.SetIndent("", "  ")
+			e.Encode(problems)
+		default:
+			for _, p := range problems {
+				fmt.Printf("%v: %v\n", configConfigSource, p)
+			}
+			if len(problems) == 0 {
+				fmt.Printf("%v is valid\n", configConfigSource)
+			}
+		}
+		if len(problems) != 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var schemaConfigCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "print the JSON Schema of the config",
+	Run: func(cmd *cobra.Command, args []string) {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(config.Schema())
+	},
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+//envPrefix starts the name of the environment variable of each flag
+const envPrefix = "CLOUD_SFTP_"
+
+//envName returns the environment variable setting flag, such as CLOUD_SFTP_BIND_ADDR for --bind-addr
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+//setFlagsFromEnv sets the flags of cmd that weren't given on the command line from their environment
+//variables, so flags take precedence over the environment
+func setFlagsFromEnv(cmd *cobra.Command, args []string) error {
+	var err error
+	flags := cmd.Flags()
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Name == "help" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("Invalid %v %q: %v", envName(f.Name), value, setErr)
+		}
+	})
+	return err
+}
@@ -10,6 +10,12 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "cloud-sftp",
 	Short: "Start a cloud-sftp server",
+	Long: `Start a cloud-sftp server
+
+Every flag can also be set by an environment variable named after it, such as
+CLOUD_SFTP_BIND_ADDR for --bind-addr. Flags take precedence over environment
+variables, which take precedence over the config file.`,
+	PersistentPreRunE: setFlagsFromEnv,
 }
 
 //Execute starts command line application
@@ -1,24 +1,115 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/shidel-dev/cloud-sftp/cloudfs"
 	"github.com/shidel-dev/cloud-sftp/config"
 	"github.com/shidel-dev/cloud-sftp/server"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/crypto/ssh"
 )
 
+var serverBindAddr string
 var serverPort int
+var serverLogLevel string
+var serverLogFormat string
+var serverStorageURL string
 var serverConfigSource string
 var serverPrivateKey string
+var serverStagingDir string
+var serverStagingMaxBytes int64
+var serverStagingMaxFiles int
+var serverCacheDir string
+var serverCacheMaxBytes int64
+var serverAdminAddr string
+var serverAdminToken string
+var serverPrefetchChunkSize int64
+var serverPrefetchPerFile int
+var serverPrefetchTotal int
+var serverPrefetchMaxMemory int64
+var serverPrefetchMinSize int64
+var serverSpillDir string
+var serverSpillMaxBytes int64
+var serverReorderWindow int
+var serverUploadBufferSize int
+var serverUploadPartSize int
+var serverUploadConcurrency int
+var serverMaxAuthFailures int
+var serverAuthFailureWindow time.Duration
+var serverBanDuration time.Duration
+var serverAuthFailureDelay time.Duration
+var serverAllowedCIDRs []string
+var serverDeniedCIDRs []string
+var serverMaxConnections int
+var serverMaxPendingConnections int
+var serverHandshakeTimeout time.Duration
+var serverMaxConnectionsPerIP int
+var serverMaxConnectionsPerUser int
+var serverMaxChannelsPerConnection int
+var serverIdleTimeout time.Duration
+var serverMaxSessionDuration time.Duration
+var serverKeepaliveInterval time.Duration
+var serverKeepaliveCountMax int
+var serverShutdownGracePeriod time.Duration
+var serverConfigPollInterval time.Duration
+var serverDisconnectRemovedUsers bool
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
+	serverCmd.PersistentFlags().StringVar(&serverBindAddr, "bind-addr", "0.0.0.0", "address the ssh/sftp port is bound to")
 	serverCmd.PersistentFlags().IntVarP(&serverPort, "port", "p", 22, "ssh/sftp port")
-	serverCmd.PersistentFlags().StringVarP(&serverConfigSource, "config-source", "c", "cloud-sftp-config.json", "file path or a blob url https://gocloud.dev/concepts/urls/")
+	serverCmd.PersistentFlags().StringVar(&serverLogLevel, "log-level", "info", "one of trace, debug, info, warn, error, fatal or panic")
+	serverCmd.PersistentFlags().StringVar(&serverLogFormat, "log-format", "text", "text or json")
+	serverCmd.PersistentFlags().StringVar(&serverStorageURL, "storage-url", "", "gocloud url of the bucket users are served from, replacing the storage_url of the config")
+	serverCmd.PersistentFlags().StringVarP(&serverConfigSource, "config-source", "c", "cloud-sftp-config.json", "json, yaml or toml file path or a blob url https://gocloud.dev/concepts/urls/")
 	serverCmd.PersistentFlags().StringVarP(&serverPrivateKey, "private-key", "k", "", "path to private key")
+	serverCmd.PersistentFlags().StringVar(&serverStagingDir, "staging-dir", "", "directory holding files opened for reading and writing, defaults to a directory in the system temp dir")
+	serverCmd.PersistentFlags().Int64Var(&serverStagingMaxBytes, "staging-max-bytes", cloudfs.DefaultStagingMaxBytes, "disk space available to the staging dir")
+	serverCmd.PersistentFlags().IntVar(&serverStagingMaxFiles, "staging-max-files", cloudfs.DefaultStagingMaxFiles, "number of files that can be open for reading and writing at once")
+	serverCmd.PersistentFlags().StringVar(&serverCacheDir, "cache-dir", "", "directory caching the contents of read files, defaults to a directory in the system temp dir")
+	serverCmd.PersistentFlags().Int64Var(&serverCacheMaxBytes, "cache-max-bytes", 0, "disk space available to the read cache, 0 disables the cache")
+	serverCmd.PersistentFlags().Int64Var(&serverPrefetchChunkSize, "prefetch-chunk-size", cloudfs.DefaultPrefetchChunkSize, "size of each range fetched ahead of a sequential download")
+	serverCmd.PersistentFlags().IntVar(&serverPrefetchPerFile, "prefetch-per-file", cloudfs.DefaultPrefetchPerFile, "ranges fetched concurrently for one file, -1 disables prefetching")
+	serverCmd.PersistentFlags().IntVar(&serverPrefetchTotal, "prefetch-total", cloudfs.DefaultPrefetchTotal, "ranges fetched concurrently across every session")
+	serverCmd.PersistentFlags().Int64Var(&serverPrefetchMaxMemory, "prefetch-max-memory", cloudfs.DefaultPrefetchMaxMemory, "memory available to prefetched ranges across every session")
+	serverCmd.PersistentFlags().Int64Var(&serverPrefetchMinSize, "prefetch-min-size", cloudfs.DefaultPrefetchMinSize, "size a file must have before its downloads are prefetched")
+	serverCmd.PersistentFlags().StringVar(&serverSpillDir, "spill-dir", "", "directory buffering uploads written out of order, defaults to a directory in the system temp dir")
+	serverCmd.PersistentFlags().Int64Var(&serverSpillMaxBytes, "spill-max-bytes", cloudfs.DefaultSpillMaxBytes, "disk space available to the spill dir")
+	serverCmd.PersistentFlags().IntVar(&serverReorderWindow, "reorder-window", cloudfs.DefaultReorderWindow, "memory each upload may use to hold out of order writes before spilling to disk")
+	serverCmd.PersistentFlags().IntVar(&serverUploadBufferSize, "upload-buffer-size", 0, "size of the buffer collecting client writes before they are uploaded, 0 disables it")
+	serverCmd.PersistentFlags().IntVar(&serverUploadPartSize, "upload-part-size", 0, "size of each S3 part, Azure block or GCS chunk, 0 uses the driver's default")
+	serverCmd.PersistentFlags().IntVar(&serverUploadConcurrency, "upload-concurrency", 0, "number of Azure blocks uploaded in parallel, 0 uses the driver's default. It has no effect on S3, which always uploads 5 parts in parallel")
+	serverCmd.PersistentFlags().StringVar(&serverAdminAddr, "admin-addr", "", "address serving metrics at /debug/vars and bans at /bans, disabled when empty")
+	serverCmd.PersistentFlags().StringVar(&serverAdminToken, "admin-token", "", "bearer token required to clear bans at /bans, without one they can only be cleared from localhost")
+	serverCmd.PersistentFlags().IntVar(&serverMaxAuthFailures, "max-auth-failures", server.DefaultMaxAuthFailures, "failed sign ins within the window before a client ip or username is banned, -1 disables bans")
+	serverCmd.PersistentFlags().DurationVar(&serverAuthFailureWindow, "auth-failure-window", server.DefaultAuthFailureWindow, "sliding window failed sign ins are counted in")
+	serverCmd.PersistentFlags().DurationVar(&serverBanDuration, "ban-duration", server.DefaultBanDuration, "how long a client ip or username stays banned")
+	serverCmd.PersistentFlags().DurationVar(&serverAuthFailureDelay, "auth-failure-delay", server.DefaultAuthFailureDelay, "delay after a failed password, doubling with each further failure, -1ns disables it")
+	serverCmd.PersistentFlags().StringSliceVar(&serverAllowedCIDRs, "allow-cidr", nil, "networks clients may connect from, replacing the allowed_cidrs of the config, every network when both are empty")
+	serverCmd.PersistentFlags().StringSliceVar(&serverDeniedCIDRs, "deny-cidr", nil, "networks clients may not connect from, replacing the denied_cidrs of the config and taking precedence over --allow-cidr")
+	serverCmd.PersistentFlags().IntVar(&serverMaxConnections, "max-connections", 0, "authenticated connections served at once, 0 is unlimited")
+	serverCmd.PersistentFlags().IntVar(&serverMaxPendingConnections, "max-pending-connections", 0, "connections that haven't finished signing in, 0 is unlimited")
+	serverCmd.PersistentFlags().DurationVar(&serverHandshakeTimeout, "handshake-timeout", server.DefaultHandshakeTimeout, "time a connection has to sign in, a negative value disables it")
+	serverCmd.PersistentFlags().IntVar(&serverMaxConnectionsPerIP, "max-connections-per-ip", 0, "authenticated connections from one client ip, 0 is unlimited")
+	serverCmd.PersistentFlags().IntVar(&serverMaxConnectionsPerUser, "max-connections-per-user", 0, "authenticated connections of one user, 0 is unlimited")
+	serverCmd.PersistentFlags().IntVar(&serverMaxChannelsPerConnection, "max-channels-per-connection", 0, "sftp sessions open at once on one connection, 0 is unlimited")
+	serverCmd.PersistentFlags().DurationVar(&serverIdleTimeout, "idle-timeout", 0, "close connections without sftp packets for this long, 0 disables it")
+	serverCmd.PersistentFlags().DurationVar(&serverMaxSessionDuration, "max-session-duration", 0, "close connections this long after they authenticated, 0 disables it")
+	serverCmd.PersistentFlags().DurationVar(&serverKeepaliveInterval, "keepalive-interval", 0, "how often clients are sent keepalive requests, 0 disables them")
+	serverCmd.PersistentFlags().IntVar(&serverKeepaliveCountMax, "keepalive-count-max", server.DefaultKeepaliveCountMax, "unanswered keepalives after which a connection is closed")
+	serverCmd.PersistentFlags().DurationVar(&serverShutdownGracePeriod, "shutdown-grace-period", 30*time.Second, "time in-flight uploads get to finish on SIGTERM or SIGINT before they are cancelled, idle connections are closed right away")
+	serverCmd.PersistentFlags().DurationVar(&serverConfigPollInterval, "config-poll-interval", 5*time.Second, "how often the config source is checked for changes, which are also loaded on SIGHUP, 0 disables polling")
+	serverCmd.PersistentFlags().BoolVar(&serverDisconnectRemovedUsers, "disconnect-removed-users", false, "close the connections of users removed from or disabled in a reloaded config")
 	serverCmd.MarkFlagRequired("private-key")
 	serverCmd.MarkFlagFilename("private-key")
 }
@@ -27,7 +118,9 @@ var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Start a cloud-sftp server",
 	Run: func(cmd *cobra.Command, args []string) {
-		log.SetLevel(log.DebugLevel)
+		if err := setupLogging(serverLogLevel, serverLogFormat); err != nil {
+			log.Fatal(err)
+		}
 		privateBytes, err := ioutil.ReadFile(serverPrivateKey)
 		if err != nil {
 			log.Fatal("Failed to load private key", err)
@@ -44,21 +137,204 @@ var serverCmd = &cobra.Command{
 		}
 
 		configDefaults := server.Config{
-			HostKey:  private,
-			BindAddr: "0.0.0.0",
-			Port:     serverPort,
-		}
+			HostKey:         private,
+			BindAddr:        serverBindAddr,
+			Port:            serverPort,
+			StagingDir:      serverStagingDir,
+			StagingMaxBytes: serverStagingMaxBytes,
+			StagingMaxFiles: serverStagingMaxFiles,
+			CacheDir:        serverCacheDir,
+			CacheMaxBytes:   serverCacheMaxBytes,
+			AdminAddr:       serverAdminAddr,
+			AdminToken:      serverAdminToken,
+
+			PrefetchChunkSize: serverPrefetchChunkSize,
+			PrefetchPerFile:   serverPrefetchPerFile,
+			PrefetchTotal:     serverPrefetchTotal,
+			PrefetchMaxMemory: serverPrefetchMaxMemory,
+			PrefetchMinSize:   serverPrefetchMinSize,
+
+			SpillDir:      serverSpillDir,
+			SpillMaxBytes: serverSpillMaxBytes,
+			ReorderWindow: serverReorderWindow,
 
-		serverConfig, err := configProvider.ServerConfig(configDefaults)
+			UploadBufferSize:  serverUploadBufferSize,
+			UploadPartSize:    serverUploadPartSize,
+			UploadConcurrency: serverUploadConcurrency,
+
+			MaxAuthFailures:   serverMaxAuthFailures,
+			AuthFailureWindow: serverAuthFailureWindow,
+			BanDuration:       serverBanDuration,
+			AuthFailureDelay:  serverAuthFailureDelay,
+
+			MaxConnections:           serverMaxConnections,
+			MaxPendingConnections:    serverMaxPendingConnections,
+			HandshakeTimeout:         serverHandshakeTimeout,
+			MaxConnectionsPerIP:      serverMaxConnectionsPerIP,
+			MaxConnectionsPerUser:    serverMaxConnectionsPerUser,
+			MaxChannelsPerConnection: serverMaxChannelsPerConnection,
+
+			IdleTimeout:        serverIdleTimeout,
+			MaxSessionDuration: serverMaxSessionDuration,
+			KeepaliveInterval:  serverKeepaliveInterval,
+			KeepaliveCountMax:  serverKeepaliveCountMax,
+		}
 
+		c, err := readValidConfig(configProvider)
 		if err != nil {
 			log.Fatal(err)
 		}
+		//the loader keeps the buckets of mounts open across reloads
+		loader := config.NewLoader()
+		serverConfig, err := loader.ServerConfig(configDefaults, overrideConfig(c, cmd.Flags()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if serverUploadConcurrency > 0 && strings.HasPrefix(c.StorageURL, "s3://") {
+			log.Warn("--upload-concurrency only applies to Azure, the S3 driver always uploads 5 parts in parallel")
+		}
+		log.WithFields(log.Fields{
+			"buffer_size": serverConfig.UploadBufferSize,
+			"part_size":   serverConfig.UploadPartSize,
+			"concurrency": serverConfig.UploadConcurrency,
+		}).Info("Upload options")
+
+		//signals are caught before the server listens, a SIGHUP would otherwise stop a server just started
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
 		server := server.New(serverConfig)
-		err = server.ListenAndServe(nil)
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- server.ListenAndServe(nil)
+		}()
+
+		//a config that fails to load or validate is logged and the current one is kept
+		reload := func(reason string) {
+			c, err := readValidConfig(configProvider)
+			if err != nil {
+				log.Errorf("Failed to reload config after %v, keeping the current one %v", reason, err)
+				return
+			}
+			reloaded, err := loader.ServerConfig(configDefaults, overrideConfig(c, cmd.Flags()))
+			if err != nil {
+				log.Errorf("Failed to reload config after %v, keeping the current one %v", reason, err)
+				return
+			}
+			if err := server.Reload(reloaded); err != nil {
+				log.Errorf("Failed to reload config after %v, keeping the current one %v", reason, err)
+				return
+			}
+			log.Infof("Reloaded config after %v", reason)
+
+			if serverDisconnectRemovedUsers {
+				closed := server.Disconnect(func(conn ssh.ConnMetadata) bool {
+					return !c.Allows(conn.User())
+				})
+				log.Infof("Disconnected %v connections of removed or disabled users", closed)
+			}
+		}
+
+		watchCtx, stopWatching := context.WithCancel(context.Background())
+		defer stopWatching()
+		if serverConfigPollInterval > 0 {
+			go configProvider.Watch(watchCtx, serverConfigPollInterval, func() {
+				reload("a change of the config source")
+			})
+		}
+
+	wait:
+		for {
+			select {
+			case err := <-stopped:
+				if err != nil {
+					log.Fatal("Failed to start server", err)
+				}
+				return
+			case <-hangups:
+				reload("SIGHUP")
+			case sig := <-signals:
+				log.Infof("Received %v, closing idle connections and waiting up to %v for uploads", sig, serverShutdownGracePeriod)
+				break wait
+			}
+		}
+		stopWatching()
+
+		ctx, cancel := context.WithTimeout(context.Background(), serverShutdownGracePeriod)
+		defer cancel()
+		summary, err := server.Shutdown(ctx)
+		log.WithFields(log.Fields{"drained": summary.Drained, "cancelled": summary.Cancelled}).Info("Server stopped")
 		if err != nil {
-			log.Fatal("Failed to start server", err)
+			os.Exit(1)
 		}
 	},
 }
+
+//overrideConfig replaces the settings of c given as flags or environment variables, which setFlagsFromEnv
+//has already turned into flags
+func overrideConfig(c *config.ServerConfig, flags *pflag.FlagSet) *config.ServerConfig {
+	if len(serverStorageURL) != 0 {
+		c.StorageURL = serverStorageURL
+	}
+	if len(serverAllowedCIDRs) != 0 {
+		c.AllowedCIDRs = serverAllowedCIDRs
+	}
+	if len(serverDeniedCIDRs) != 0 {
+		c.DeniedCIDRs = serverDeniedCIDRs
+	}
+	//the upload flags only replace the settings of the upload block that were given, a flag left at
+	//its default keeps the value of the config
+	if flags.Changed("upload-buffer-size") || flags.Changed("upload-part-size") || flags.Changed("upload-concurrency") {
+		upload := config.UploadConfig{}
+		if c.Upload != nil {
+			upload = *c.Upload
+		}
+		if flags.Changed("upload-buffer-size") {
+			upload.BufferSize = serverUploadBufferSize
+		}
+		if flags.Changed("upload-part-size") {
+			upload.PartSize = serverUploadPartSize
+		}
+		if flags.Changed("upload-concurrency") {
+			upload.Concurrency = serverUploadConcurrency
+		}
+		c.Upload = &upload
+	}
+	return c
+}
+
+//readValidConfig returns the config, or logs every problem of it and returns an error if there are any.
+//The config is read once, so the version validated is the one returned.
+func readValidConfig(configProvider config.Provider) (*config.ServerConfig, error) {
+	c, problems, err := configProvider.ReadValidConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range problems {
+		log.WithFields(log.Fields{"line": p.Line, "field": p.Field}).Error(p.Message)
+	}
+	if len(problems) != 0 {
+		return nil, fmt.Errorf("Invalid config %v, %v problems found", serverConfigSource, len(problems))
+	}
+	return c, nil
+}
+
+func setupLogging(level string, format string) error {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(l)
+
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Unknown log format %v", format)
+	}
+	return nil
+}
@@ -1,27 +1,75 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/shidel-dev/cloud-sftp/config"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
 var userConfigSource string
 var username string
 var password string
+var publicKeyFile string
+var keyComment string
+var keyExpires string
+var mfaIssuer string
+var newUsername string
+var userOutput string
 
 func init() {
 	rootCmd.AddCommand(userCmd)
-	userCmd.PersistentFlags().StringVarP(&userConfigSource, "config-source", "c", "cloud-sftp-config.json", "file path or a blob url https://gocloud.dev/concepts/urls/")
+	userCmd.PersistentFlags().StringVarP(&userConfigSource, "config-source", "c", "cloud-sftp-config.json", "json, yaml or toml file path or a blob url https://gocloud.dev/concepts/urls/")
+	userCmd.PersistentFlags().StringVarP(&userOutput, "output", "o", "text", "text or json, for list and show")
 	userCmd.MarkFlagRequired("config-source")
 	userCmd.AddCommand(addUserCmd)
+	userCmd.AddCommand(listUsersCmd)
+	userCmd.AddCommand(showUserCmd)
+	userCmd.AddCommand(removeUserCmd)
+	userCmd.AddCommand(passwdCmd)
+	userCmd.AddCommand(disableUserCmd)
+	userCmd.AddCommand(enableUserCmd)
+	userCmd.AddCommand(renameUserCmd)
+	userCmd.AddCommand(keyCmd)
+	keyCmd.AddCommand(addKeyCmd)
+	userCmd.AddCommand(mfaCmd)
+	mfaCmd.AddCommand(enrollMFACmd)
 
 	addUserCmd.Flags().StringVar(&username, "username", "", "")
 	addUserCmd.Flags().StringVar(&password, "password", "", "")
-	addUserCmd.MarkFlagRequired("password")
+	addUserCmd.Flags().StringVar(&publicKeyFile, "public-key-file", "", "authorized_keys formatted public key the user may sign in with, such as ~/.ssh/id_ed25519.pub")
 	addUserCmd.MarkFlagRequired("username")
+
+	addKeyCmd.Flags().StringVar(&username, "username", "", "")
+	addKeyCmd.Flags().StringVar(&publicKeyFile, "public-key-file", "", "authorized_keys formatted public key, such as ~/.ssh/id_ed25519.pub")
+	addKeyCmd.Flags().StringVar(&keyComment, "comment", "", "replaces the comment of the key")
+	addKeyCmd.Flags().StringVar(&keyExpires, "expires", "", "RFC 3339 time after which the key is no longer accepted")
+	addKeyCmd.MarkFlagRequired("username")
+	addKeyCmd.MarkFlagRequired("public-key-file")
+
+	for _, cmd := range []*cobra.Command{showUserCmd, removeUserCmd, passwdCmd, disableUserCmd, enableUserCmd, renameUserCmd} {
+		cmd.Flags().StringVar(&username, "username", "", "")
+		cmd.MarkFlagRequired("username")
+	}
+	renameUserCmd.Flags().StringVar(&newUsername, "new-username", "", "")
+	renameUserCmd.MarkFlagRequired("new-username")
+
+	enrollMFACmd.Flags().StringVar(&username, "username", "", "")
+	enrollMFACmd.Flags().StringVar(&mfaIssuer, "issuer", "cloud-sftp", "name authenticator apps show for the account")
+	enrollMFACmd.MarkFlagRequired("username")
 }
 
 var userCmd = &cobra.Command{
@@ -33,15 +81,362 @@ var addUserCmd = &cobra.Command{
 	Use:   "add",
 	Short: "add a user",
 	Run: func(cmd *cobra.Command, args []string) {
+		if len(password) == 0 && len(publicKeyFile) == 0 {
+			log.Fatal(errors.New("A password or a public key file is required"))
+		}
+
 		fmt.Println(userConfigSource)
 		configProvider, err := config.ParseConfigSource(userConfigSource)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		err = configProvider.AddUser(username, password, []byte{})
+		publicKey := []byte{}
+		if len(publicKeyFile) != 0 {
+			publicKey, err = ioutil.ReadFile(publicKeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			publicKey = bytes.TrimSpace(publicKey)
+		}
+
+		err = configProvider.AddUser(username, password, publicKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+//userSummary is what list and show print about a user, leaving out their secrets
+type userSummary struct {
+	UserName     string               `json:"username"`
+	Disabled     bool                 `json:"disabled"`
+	Password     bool                 `json:"password"`
+	MFA          bool                 `json:"mfa"`
+	PublicKeys   []keySummary         `json:"public_keys"`
+	Groups       []string             `json:"groups,omitempty"`
+	Permissions  []string             `json:"permissions,omitempty"`
+	StorageURL   string               `json:"storage_url,omitempty"`
+	Mounts       []config.MountConfig `json:"mounts,omitempty"`
+	AllowedCIDRs []string             `json:"allowed_cidrs,omitempty"`
+}
+
+type keySummary struct {
+	Type        string     `json:"type"`
+	Fingerprint string     `json:"fingerprint"`
+	Comment     string     `json:"comment,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+func summarizeUser(u config.UserConfig) userSummary {
+	s := userSummary{
+		UserName:     u.UserName,
+		Disabled:     u.Disabled,
+		Password:     len(u.PasswordHash) != 0,
+		MFA:          len(u.TOTPSecret) != 0,
+		PublicKeys:   []keySummary{},
+		Groups:       u.Groups,
+		Permissions:  u.Permissions,
+		StorageURL:   u.StorageURL,
+		Mounts:       u.Mounts,
+		AllowedCIDRs: u.AllowedCIDRs,
+	}
+	for _, k := range u.PublicKeys {
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Key))
+		if err != nil {
+			s.PublicKeys = append(s.PublicKeys, keySummary{Type: "invalid", Comment: k.Comment, Expires: k.Expires})
+			continue
+		}
+		if len(k.Comment) != 0 {
+			comment = k.Comment
+		}
+		s.PublicKeys = append(s.PublicKeys, keySummary{
+			Type:        key.Type(),
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Comment:     comment,
+			Expires:     k.Expires,
+		})
+	}
+	return s
+}
+
+//signIns lists how the user signs in, such as password+mfa
+func (s userSummary) signIns() string {
+	methods := []string{}
+	if s.Password {
+		methods = append(methods, "password")
+	}
+	if len(s.PublicKeys) != 0 {
+		methods = append(methods, fmt.Sprintf("%v keys", len(s.PublicKeys)))
+	}
+	if len(methods) == 0 {
+		methods = append(methods, "none")
+	}
+	signIns := strings.Join(methods, ",")
+	if s.MFA {
+		signIns += "+mfa"
+	}
+	return signIns
+}
+
+func (s userSummary) status() string {
+	if s.Disabled {
+		return "disabled"
+	}
+	return "enabled"
+}
+
+func printJSON(v interface{}) {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	if err := e.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
+
+var listUsersCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the users",
+	Run: func(cmd *cobra.Command, args []string) {
+		configProvider, err := config.ParseConfigSource(userConfigSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		users, err := configProvider.ListUsers()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		summaries := []userSummary{}
+		for _, u := range users {
+			summaries = append(summaries, summarizeUser(u))
+		}
+		if userOutput == "json" {
+			printJSON(summaries)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tSTATUS\tSIGN IN\tGROUPS")
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", s.UserName, s.status(), s.signIns(), strings.Join(s.Groups, ","))
+		}
+		w.Flush()
+	},
+}
+
+var showUserCmd = &cobra.Command{
+	Use:   "show",
+	Short: "show a user, leaving out their password hash and totp secret",
+	Run: func(cmd *cobra.Command, args []string) {
+		configProvider, err := config.ParseConfigSource(userConfigSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		u, err := configProvider.GetUser(username)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s := summarizeUser(*u)
+		if userOutput == "json" {
+			printJSON(s)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "username:\t%v\n", s.UserName)
+		fmt.Fprintf(w, "status:\t%v\n", s.status())
+		fmt.Fprintf(w, "sign in:\t%v\n", s.signIns())
+		if len(s.Groups) != 0 {
+			fmt.Fprintf(w, "groups:\t%v\n", strings.Join(s.Groups, ","))
+		}
+		if s.Permissions != nil {
+			fmt.Fprintf(w, "permissions:\t%v\n", strings.Join(s.Permissions, ","))
+		}
+		if len(s.StorageURL) != 0 {
+			fmt.Fprintf(w, "storage url:\t%v\n", s.StorageURL)
+		}
+		for _, m := range s.Mounts {
+			fmt.Fprintf(w, "mount:\t%v %v\n", m.Path, m.StorageURL)
+		}
+		if len(s.AllowedCIDRs) != 0 {
+			fmt.Fprintf(w, "allowed cidrs:\t%v\n", strings.Join(s.AllowedCIDRs, ","))
+		}
+		for _, k := range s.PublicKeys {
+			key := fmt.Sprintf("%v %v %v", k.Type, k.Fingerprint, k.Comment)
+			if k.Expires != nil {
+				key += fmt.Sprintf(" expires %v", k.Expires.Format(time.RFC3339))
+			}
+			fmt.Fprintf(w, "public key:\t%v\n", strings.TrimSpace(key))
+		}
+		w.Flush()
+	},
+}
+
+var removeUserCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "remove a user along with their name in the acl rules",
+	Run: func(cmd *cobra.Command, args []string) {
+		configProvider, err := config.ParseConfigSource(userConfigSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := configProvider.RemoveUser(username); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+//readPassword prompts for a new password twice on a terminal, otherwise it reads a line of stdin
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Retype new password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", errors.New("Passwords don't match")
+	}
+	return string(first), nil
+}
+
+var passwdCmd = &cobra.Command{
+	Use:   "passwd",
+	Short: "set the password of a user, read from the terminal or stdin",
+	Run: func(cmd *cobra.Command, args []string) {
+		configProvider, err := config.ParseConfigSource(userConfigSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		newPassword, err := readPassword()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := configProvider.SetPassword(username, newPassword); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func setDisabled(disabled bool) {
+	configProvider, err := config.ParseConfigSource(userConfigSource)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := configProvider.SetDisabled(username, disabled); err != nil {
+		log.Fatal(err)
+	}
+}
+
+var disableUserCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "keep a user from signing in without removing them",
+	Run: func(cmd *cobra.Command, args []string) {
+		setDisabled(true)
+	},
+}
+
+var enableUserCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "let a disabled user sign in again",
+	Run: func(cmd *cobra.Command, args []string) {
+		setDisabled(false)
+	},
+}
+
+var renameUserCmd = &cobra.Command{
+	Use:   "rename",
+	Short: "rename a user along with the acl rules naming them",
+	Run: func(cmd *cobra.Command, args []string) {
+		configProvider, err := config.ParseConfigSource(userConfigSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := configProvider.RenameUser(username, newUsername); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage the public keys of users",
+}
+
+var addKeyCmd = &cobra.Command{
+	Use:   "add",
+	Short: "add a public key to a user",
+	Run: func(cmd *cobra.Command, args []string) {
+		configProvider, err := config.ParseConfigSource(userConfigSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		publicKey, err := ioutil.ReadFile(publicKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		key := config.PublicKeyConfig{
+			Key:     strings.TrimSpace(string(publicKey)),
+			Comment: keyComment,
+		}
+		if len(keyExpires) != 0 {
+			expires, err := time.Parse(time.RFC3339, keyExpires)
+			if err != nil {
+				log.Fatal(err)
+			}
+			key.Expires = &expires
+		}
+
+		err = configProvider.AddPublicKey(username, key)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var mfaCmd = &cobra.Command{
+	Use:   "mfa",
+	Short: "Manage the second factor of users",
+}
+
+var enrollMFACmd = &cobra.Command{
+	Use:   "enroll",
+	Short: "enable totp for a user and print the otpauth uri to add to an authenticator app",
+	Run: func(cmd *cobra.Command, args []string) {
+		configProvider, err := config.ParseConfigSource(userConfigSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		secret, err := configProvider.EnrollMFA(username)
 		if err != nil {
 			log.Fatal(err)
 		}
+		fmt.Println(config.TOTPURI(mfaIssuer, username, secret))
 	},
 }
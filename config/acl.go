@@ -0,0 +1,206 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/shidel-dev/cloud-sftp/cloudfs"
+)
+
+//ACLRule allows or denies operations on the paths matching a glob pattern. Rules are evaluated in order
+//and the first one that matches the user, the path and the operation decides. A rule without users or
+//groups applies to everyone.
+type ACLRule struct {
+	//Path is a glob pattern, * and ? match within a path segment and ** matches any number of segments
+	Path   string   `json:"path"`
+	Allow  []string `json:"allow,omitempty"`
+	Deny   []string `json:"deny,omitempty"`
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+func (r ACLRule) String() string {
+	s := r.Path
+	if len(r.Allow) != 0 {
+		s += " allow " + strings.Join(r.Allow, ",")
+	}
+	if len(r.Deny) != 0 {
+		s += " deny " + strings.Join(r.Deny, ",")
+	}
+	if len(r.Users) != 0 {
+		s += " users " + strings.Join(r.Users, ",")
+	}
+	if len(r.Groups) != 0 {
+		s += " groups " + strings.Join(r.Groups, ",")
+	}
+	return s
+}
+
+type aclRule struct {
+	ACLRule
+	index int
+	allow cloudfs.Permissions
+	deny  cloudfs.Permissions
+}
+
+func compileACL(rules []ACLRule) ([]aclRule, error) {
+	compiled := make([]aclRule, 0, len(rules))
+	for i, r := range rules {
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, fmt.Errorf("ACL rule %v: path %q must start with /", i, r.Path)
+		}
+		if _, err := path.Match(r.Path, ""); err != nil {
+			return nil, fmt.Errorf("ACL rule %v: invalid path %q", i, r.Path)
+		}
+		allow, err := cloudfs.ParsePermissions(r.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("ACL rule %v: %v", i, err)
+		}
+		deny, err := cloudfs.ParsePermissions(r.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("ACL rule %v: %v", i, err)
+		}
+		if allow&deny != 0 {
+			return nil, fmt.Errorf("ACL rule %v both allows and denies %v", i, allow&deny)
+		}
+		compiled = append(compiled, aclRule{
+			ACLRule: r,
+			index:   i,
+			allow:   allow,
+			deny:    deny,
+		})
+	}
+	return compiled, nil
+}
+
+//appliesTo reports whether the rule applies to the user
+func (r *aclRule) appliesTo(u *UserConfig) bool {
+	if len(r.Users) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	for _, name := range r.Users {
+		if name == u.UserName {
+			return true
+		}
+	}
+	for _, group := range r.Groups {
+		for _, g := range u.Groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Decision explains the outcome of evaluating the ACL for an operation
+type Decision struct {
+	Allowed bool
+	//Rule is the index of the rule that decided, or -1 when the user's permissions decided
+	Rule int
+	//Reason describes what decided
+	Reason string
+}
+
+//aclAuthorizer evaluates the ACL rules that apply to one user, falling back to the user's permissions
+type aclAuthorizer struct {
+	rules       []aclRule
+	permissions cloudfs.Permissions
+}
+
+func newACLAuthorizer(rules []aclRule, u *UserConfig, permissions cloudfs.Permissions) *aclAuthorizer {
+	a := &aclAuthorizer{permissions: permissions}
+	for _, r := range rules {
+		if r.appliesTo(u) {
+			a.rules = append(a.rules, r)
+		}
+	}
+	return a
+}
+
+//Allowed implements cloudfs.Authorizer
+func (a *aclAuthorizer) Allowed(perm cloudfs.Permissions, p string) bool {
+	return a.explain(perm, p).Allowed
+}
+
+func (a *aclAuthorizer) explain(perm cloudfs.Permissions, p string) Decision {
+	p = path.Clean("/" + p)
+	for _, r := range a.rules {
+		if (r.allow|r.deny)&perm == 0 || !matchGlob(r.Path, p) {
+			continue
+		}
+		allowed := r.allow.Has(perm)
+		verb := "denies"
+		if allowed {
+			verb = "allows"
+		}
+		return Decision{
+			Allowed: allowed,
+			Rule:    r.index,
+			Reason:  fmt.Sprintf("rule %v (%v) %v %v", r.index, r.ACLRule, verb, perm),
+		}
+	}
+
+	allowed := a.permissions.Has(perm)
+	return Decision{
+		Allowed: allowed,
+		Rule:    -1,
+		Reason:  fmt.Sprintf("no rule matched, the user's permissions are %q", a.permissions.String()),
+	}
+}
+
+//Explain evaluates the ACL of c for an operation by username on p, and explains the outcome
+func Explain(c *ServerConfig, username string, perm cloudfs.Permissions, p string) (Decision, error) {
+	rules, err := compileACL(c.ACL)
+	if err != nil {
+		return Decision{}, err
+	}
+	for i := range c.Users {
+		u := &c.Users[i]
+		if u.UserName != username {
+			continue
+		}
+		permissions, err := u.permissions()
+		if err != nil {
+			return Decision{}, err
+		}
+		return newACLAuthorizer(rules, u, permissions).explain(perm, p), nil
+	}
+	return Decision{}, fmt.Errorf("Unknown user %v", username)
+}
+
+//matchGlob matches p against pattern segment by segment, ** matches any number of segments
+func matchGlob(pattern string, p string) bool {
+	return matchSegments(splitPath(pattern), splitPath(p))
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if len(p) == 0 {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func matchSegments(pattern []string, p []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(p); i++ {
+				if matchSegments(pattern[1:], p[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(p) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], p[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		p = p[1:]
+	}
+	return len(p) == 0
+}
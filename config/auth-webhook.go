@@ -0,0 +1,279 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/shidel-dev/cloud-sftp/cloudfs"
+	"github.com/shidel-dev/cloud-sftp/server"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultAuthWebhookTimeout = 5 * time.Second
+	defaultAuthWebhookCache   = 30 * time.Second
+)
+
+var errAuthUnavailable = errors.New("authentication service unavailable")
+
+//AuthWebhookConfig authenticates users with an http endpoint instead of the users of the config
+type AuthWebhookConfig struct {
+	//URL receives a POST of the credentials of each sign in attempt
+	URL string `json:"url"`
+	//TimeoutSeconds bounds each request, it defaults to 5
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	//CacheSeconds is how long the sessions an endpoint allows are remembered, it defaults to 30
+	CacheSeconds int `json:"cache_seconds,omitempty"`
+	//FallbackToUsers signs in the users of the config while the endpoint fails, otherwise every sign in is refused
+	FallbackToUsers bool `json:"fallback_to_users,omitempty"`
+}
+
+//authRequest is the body posted to the endpoint
+type authRequest struct {
+	Method               string `json:"method"`
+	Username             string `json:"username"`
+	ClientIP             string `json:"client_ip"`
+	Password             string `json:"password,omitempty"`
+	PublicKey            string `json:"public_key,omitempty"`
+	PublicKeyFingerprint string `json:"public_key_fingerprint,omitempty"`
+}
+
+//authResponse is the decision of the endpoint, and the session of allowed users
+type authResponse struct {
+	Allow bool `json:"allow"`
+	//HomeDir is the prefix of the bucket the session is rooted at
+	HomeDir        string   `json:"home_dir,omitempty"`
+	Permissions    []string `json:"permissions,omitempty"`
+	Groups         []string `json:"groups,omitempty"`
+	StorageURL     string   `json:"storage_url,omitempty"`
+	StorageProfile string   `json:"storage_profile,omitempty"`
+}
+
+type cachedAuth struct {
+	user    *UserConfig
+	expires time.Time
+}
+
+type authWebhook struct {
+	config   *AuthWebhookConfig
+	server   *ServerConfig
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedAuth
+}
+
+//webhookUserExtension holds the user the endpoint allowed in the permissions of the connection
+const webhookUserExtension = "cloud-sftp-webhook-user"
+
+func newAuthWebhook(c *ServerConfig) (*authWebhook, error) {
+	u, err := url.Parse(c.AuthWebhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid auth webhook url %v", c.AuthWebhook.URL)
+	}
+
+	timeout := defaultAuthWebhookTimeout
+	if c.AuthWebhook.TimeoutSeconds > 0 {
+		timeout = time.Duration(c.AuthWebhook.TimeoutSeconds) * time.Second
+	}
+	cacheTTL := defaultAuthWebhookCache
+	if c.AuthWebhook.CacheSeconds > 0 {
+		cacheTTL = time.Duration(c.AuthWebhook.CacheSeconds) * time.Second
+	}
+
+	return &authWebhook{
+		config:   c.AuthWebhook,
+		server:   c,
+		client:   &http.Client{Timeout: timeout},
+		cacheTTL: cacheTTL,
+		cache:    map[string]cachedAuth{},
+	}, nil
+}
+
+//webhookPermissions returns the permissions of a connection signed in as u
+func webhookPermissions(u *UserConfig) (*ssh.Permissions, error) {
+	d, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{Extensions: map[string]string{webhookUserExtension: string(d)}}, nil
+}
+
+//user returns the user the endpoint allowed on the connection, or nil when it was signed in by the
+//users of the config. The user comes from the permissions of the key the client signed with, not of
+//the keys it only asked about.
+func (w *authWebhook) user(cm ssh.ConnMetadata) *UserConfig {
+	permissions := server.Permissions(cm)
+	if permissions == nil {
+		return nil
+	}
+	d, ok := permissions.Extensions[webhookUserExtension]
+	if !ok {
+		return nil
+	}
+	var u UserConfig
+	if err := json.Unmarshal([]byte(d), &u); err != nil {
+		log.WithField("user", cm.User()).Errorf("Failed to decode the user allowed by the auth webhook %v", err)
+		return &UserConfig{UserName: cm.User(), Permissions: []string{}}
+	}
+	return &u
+}
+
+//authenticate asks the endpoint about req and returns the permissions of the user it allows. Allowed
+//sessions are cached for a short time, denials are not so a corrected password or key works right away.
+func (w *authWebhook) authenticate(cm ssh.ConnMetadata, req authRequest) (*ssh.Permissions, error) {
+	req.Username = cm.User()
+	req.ClientIP, _, _ = net.SplitHostPort(cm.RemoteAddr().String())
+
+	d, err := json.Marshal(&req)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(d)
+	cacheKey := hex.EncodeToString(sum[:])
+
+	w.mu.Lock()
+	cached, ok := w.cache[cacheKey]
+	if ok && time.Now().After(cached.expires) {
+		delete(w.cache, cacheKey)
+		ok = false
+	}
+	w.mu.Unlock()
+
+	user := cached.user
+	if !ok {
+		user, err = w.post(d, cm.User())
+		if err != nil {
+			return nil, err
+		}
+		w.mu.Lock()
+		w.cache[cacheKey] = cachedAuth{user: user, expires: time.Now().Add(w.cacheTTL)}
+		w.mu.Unlock()
+	}
+	return webhookPermissions(user)
+}
+
+func (w *authWebhook) post(d []byte, username string) (*UserConfig, error) {
+	logger := log.WithFields(log.Fields{"user": username, "url": w.config.URL})
+
+	resp, err := w.client.Post(w.config.URL, "application/json", bytes.NewReader(d))
+	if err != nil {
+		logger.Errorf("Auth webhook failed %v", err)
+		return nil, errAuthUnavailable
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Errorf("Auth webhook responded with %v", resp.Status)
+		return nil, errAuthUnavailable
+	}
+
+	var decision authResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		logger.Errorf("Failed to decode auth webhook response %v", err)
+		return nil, errAuthUnavailable
+	}
+	if !decision.Allow {
+		return nil, errors.New("access denied by authentication service")
+	}
+
+	u := &UserConfig{
+		UserName:       username,
+		Permissions:    decision.Permissions,
+		Groups:         decision.Groups,
+		StorageURL:     decision.StorageURL,
+		StorageProfile: decision.StorageProfile,
+	}
+	if _, err := u.permissions(); err != nil {
+		logger.Errorf("Auth webhook responded with %v", err)
+		return nil, errAuthUnavailable
+	}
+	if len(decision.HomeDir) != 0 || len(decision.StorageURL) != 0 {
+		storageURL := decision.StorageURL
+		if len(storageURL) == 0 {
+			storageURL = w.server.StorageURL
+		}
+		if err := validateStorageURL(storageURL); err != nil {
+			logger.Errorf("Auth webhook responded with %v", err)
+			return nil, errAuthUnavailable
+		}
+		u.Mounts = []MountConfig{{
+			Path:           "/",
+			StorageURL:     storageURL,
+			StorageProfile: decision.StorageProfile,
+			Prefix:         decision.HomeDir,
+		}}
+	}
+	return u, nil
+}
+
+//fallback returns the decision of the endpoint, or that of the users of the config when the endpoint
+//failed and falling back is enabled
+func (w *authWebhook) fallback(permissions *ssh.Permissions, err error, local func() (*ssh.Permissions, error)) (*ssh.Permissions, error) {
+	if err == errAuthUnavailable && w.config.FallbackToUsers {
+		return local()
+	}
+	return permissions, err
+}
+
+//wrap replaces the callbacks of serverConfig with ones asking the endpoint. The callbacks built
+//from the config keep serving the connections authenticated by falling back, which have no user
+//of the endpoint in their permissions.
+func (w *authWebhook) wrap(serverConfig *server.Config, rules []aclRule, pool *bucketPool) {
+	passwordCallback := serverConfig.PasswordCallback
+	serverConfig.PasswordCallback = func(cm ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		permissions, err := w.authenticate(cm, authRequest{Method: "password", Password: string(password)})
+		return w.fallback(permissions, err, func() (*ssh.Permissions, error) { return passwordCallback(cm, password) })
+	}
+
+	publicKeyCallback := serverConfig.PublicKeyCallback
+	serverConfig.PublicKeyCallback = func(cm ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		permissions, err := w.authenticate(cm, authRequest{
+			Method:               "publickey",
+			PublicKey:            string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key))),
+			PublicKeyFingerprint: ssh.FingerprintSHA256(key),
+		})
+		return w.fallback(permissions, err, func() (*ssh.Permissions, error) { return publicKeyCallback(cm, key) })
+	}
+
+	authorizerCallback := serverConfig.AuthorizerCallback
+	serverConfig.AuthorizerCallback = func(cm ssh.ConnMetadata) cloudfs.Authorizer {
+		u := w.user(cm)
+		if u == nil {
+			return authorizerCallback(cm)
+		}
+		a, err := userAuthorizer(rules, u)
+		if err != nil {
+			//the permissions were checked when the response was decoded
+			return cloudfs.Permissions(0)
+		}
+		return a
+	}
+
+	mountsCallback := serverConfig.MountsCallback
+	serverConfig.MountsCallback = func(cm ssh.ConnMetadata) ([]cloudfs.Mount, error) {
+		u := w.user(cm)
+		if u == nil {
+			return mountsCallback(cm)
+		}
+		return userMounts(pool, u)
+	}
+
+	uploadOptionsCallback := serverConfig.UploadOptionsCallback
+	serverConfig.UploadOptionsCallback = func(cm ssh.ConnMetadata) cloudfs.UploadOptions {
+		if w.user(cm) != nil {
+			return cloudfs.UploadOptions{}
+		}
+		return uploadOptionsCallback(cm)
+	}
+}
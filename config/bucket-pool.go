@@ -0,0 +1,156 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/shidel-dev/cloud-sftp/cloudfs"
+	"github.com/shidel-dev/cloud-sftp/server"
+	"gocloud.dev/blob"
+	"golang.org/x/crypto/ssh"
+)
+
+//MountConfig places the bucket, or the prefix of a bucket, at storage_url on path
+type MountConfig struct {
+	Path string `json:"path"`
+	//StorageURL is a gocloud url, the path after the bucket name is the prefix of the mount, such as s3://hot/inbox/partnerA
+	StorageURL string `json:"storage_url"`
+	//StorageProfile is the AWS shared config profile used to open an s3 storage_url
+	StorageProfile string `json:"storage_profile,omitempty"`
+	//Prefix is added to the prefix of storage_url, it also applies to file urls
+	Prefix string `json:"prefix,omitempty"`
+}
+
+//bucketPool opens each bucket once and shares it between every mount and session using it
+type bucketPool struct {
+	mu      sync.Mutex
+	buckets map[string]*blob.Bucket
+}
+
+func newBucketPool() *bucketPool {
+	return &bucketPool{
+		buckets: map[string]*blob.Bucket{},
+	}
+}
+
+//splitStorageURL splits a storage url into the url of the bucket and a key prefix
+func splitStorageURL(storageURL string) (string, string, error) {
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid storage url %v: %v", storageURL, err)
+	}
+	//the path of a file url is the directory of the bucket
+	if u.Scheme == "file" || u.Scheme == "mem" {
+		return storageURL, "", nil
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	u.Path = ""
+	u.RawPath = ""
+	return u.String(), prefix, nil
+}
+
+func (p *bucketPool) mount(ctx context.Context, m MountConfig, username string) (cloudfs.Mount, error) {
+	storageURL, err := expandStorageURL(m.StorageURL, username)
+	if err != nil {
+		return cloudfs.Mount{}, err
+	}
+	bucketURL, prefix, err := splitStorageURL(storageURL)
+	if err != nil {
+		return cloudfs.Mount{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := m.StorageProfile + "\x00" + bucketURL
+	bucket, ok := p.buckets[id]
+	if !ok {
+		bucket, err = openStorage(ctx, bucketURL, m.StorageProfile)
+		if err != nil {
+			return cloudfs.Mount{}, err
+		}
+		p.buckets[id] = bucket
+	}
+
+	return cloudfs.Mount{
+		Path:     m.Path,
+		Bucket:   bucket,
+		BucketID: id,
+		Prefix:   strings.Trim(path.Join(prefix, m.Prefix), "/"),
+	}, nil
+}
+
+func validateMounts(u *UserConfig) error {
+	paths := map[string]bool{}
+	for _, m := range u.Mounts {
+		if !strings.HasPrefix(m.Path, "/") {
+			return fmt.Errorf("Mount %v of user %v must start with /", m.Path, u.UserName)
+		}
+		p := path.Clean(m.Path)
+		if paths[p] {
+			return fmt.Errorf("User %v has more than one mount at %v", u.UserName, p)
+		}
+		paths[p] = true
+		if err := validateStorageURL(m.StorageURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//mountsCallback returns the mounts of the user. prefixed also serves users whose storage url has a
+//path from a mount of that prefix, as mounts do, when the sessions without mounts open their bucket
+//from the storage urls of c.
+func mountsCallback(c *ServerConfig, pool *bucketPool, prefixed bool) server.MountsCallback {
+	return func(cm ssh.ConnMetadata) ([]cloudfs.Mount, error) {
+		u := &UserConfig{UserName: cm.User()}
+		for i := range c.Users {
+			if c.Users[i].UserName == cm.User() {
+				u = &c.Users[i]
+			}
+		}
+		if len(u.Mounts) != 0 || !prefixed {
+			return userMounts(pool, u)
+		}
+		return prefixMounts(c, pool, u)
+	}
+}
+
+//prefixMounts returns a mount at / of the storage url of u when it has a path, the bucket of a
+//session without mounts is always served from its root
+func prefixMounts(c *ServerConfig, pool *bucketPool, u *UserConfig) ([]cloudfs.Mount, error) {
+	storageURL, profile := userStorageURL(c, u)
+	if len(storageURL) == 0 {
+		return nil, nil
+	}
+	expanded, err := expandStorageURL(storageURL, u.UserName)
+	if err != nil {
+		return nil, err
+	}
+	_, prefix, err := splitStorageURL(expanded)
+	if err != nil || len(prefix) == 0 {
+		return nil, err
+	}
+	m, err := pool.mount(context.Background(), MountConfig{Path: "/", StorageURL: storageURL, StorageProfile: profile}, u.UserName)
+	if err != nil {
+		return nil, err
+	}
+	return []cloudfs.Mount{m}, nil
+}
+
+//userMounts opens the mounts of u
+func userMounts(pool *bucketPool, u *UserConfig) ([]cloudfs.Mount, error) {
+	mounts := make([]cloudfs.Mount, 0, len(u.Mounts))
+	for _, m := range u.Mounts {
+		mount, err := pool.mount(context.Background(), m, u.UserName)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//certChecker accepts OpenSSH user certificates signed by a trusted CA, and falls back to the
+//public keys of the users for plain keys. ssh.CertChecker checks that the username is one of the
+//principals, the validity window and the source-address critical option, and rejects certificates
+//with any other critical option.
+type certChecker struct {
+	checker     *ssh.CertChecker
+	authorities [][]byte
+	revoked     [][]byte
+	serials     map[uint64]bool
+	users       map[string]bool
+}
+
+//parseKeys parses keys in the authorized_keys format, what identifies them in errors
+func parseKeys(keys []string, what string) ([][]byte, error) {
+	parsed := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v %q: %v", what, k, err)
+		}
+		parsed = append(parsed, key.Marshal())
+	}
+	return parsed, nil
+}
+
+func containsKey(keys [][]byte, key ssh.PublicKey) bool {
+	k := key.Marshal()
+	for _, other := range keys {
+		if bytes.Equal(other, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func newCertChecker(c *ServerConfig, fallback func(conn ssh.ConnMetadata, key ssh.PublicKey) error) (*certChecker, error) {
+	authorities, err := parseKeys(c.UserCAKeys, "user CA key")
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := parseKeys(c.RevokedKeys, "revoked key")
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &certChecker{
+		authorities: authorities,
+		revoked:     revoked,
+		serials:     map[uint64]bool{},
+		users:       map[string]bool{},
+	}
+	for _, serial := range c.RevokedSerials {
+		cc.serials[serial] = true
+	}
+	for _, u := range c.Users {
+		cc.users[u.UserName] = true
+	}
+
+	cc.checker = &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return containsKey(cc.authorities, auth) && !containsKey(cc.revoked, auth)
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return cc.serials[cert.Serial] || containsKey(cc.revoked, cert.Key) || containsKey(cc.revoked, cert.SignatureKey)
+		},
+		UserKeyFallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if containsKey(cc.revoked, key) {
+				return nil, errors.New("public key is revoked")
+			}
+			return nil, fallback(conn, key)
+		},
+	}
+
+	return cc, nil
+}
+
+//authenticate checks a certificate or a plain public key. Certificates only sign in users of the
+//config, which hold their permissions and storage.
+func (cc *certChecker) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if !cc.users[conn.User()] {
+			return fmt.Errorf("unknown user %v", conn.User())
+		}
+		//ssh.CertChecker accepts certificates without principals for any user, sshd does not
+		if len(cert.ValidPrincipals) == 0 {
+			return errors.New("certificate has no principals")
+		}
+	}
+	_, err := cc.checker.Authenticate(conn, key)
+	return err
+}
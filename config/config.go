@@ -1,10 +1,13 @@
 package config
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/shidel-dev/cloud-sftp/cloudfs"
 	"github.com/shidel-dev/cloud-sftp/server"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh"
@@ -16,40 +19,126 @@ var validGoCloudURLPrefixes = []string{
 	"azblob://",
 }
 
-var validFileExtensions = []string{
-	"json",
+var validFileExtensions = map[string]configFormat{
+	"json": jsonFormat{},
+	"yaml": yamlFormat{},
+	"yml":  yamlFormat{},
+	"toml": tomlFormat{},
 }
 
 //Provider provides a server.Config
 type Provider interface {
 	ServerConfig(defaultConfig server.Config) (*server.Config, error)
 	AddUser(username string, password string, publicKeyString []byte) error
+	AddPublicKey(username string, key PublicKeyConfig) error
+	//EnrollMFA stores a new totp secret for the user and returns it
+	EnrollMFA(username string) (string, error)
+	ReadConfig() (*ServerConfig, error)
+	ListUsers() ([]UserConfig, error)
+	GetUser(username string) (*UserConfig, error)
+	RemoveUser(username string) error
+	SetPassword(username string, password string) error
+	SetDisabled(username string, disabled bool) error
+	RenameUser(username string, newUsername string) error
+	//Validate reports every problem of the stored config, probe also checks that its buckets can be listed
+	Validate(probe bool) ([]Problem, error)
+	//ReadValidConfig reads the config once, and decodes it when it has no problems
+	ReadValidConfig() (*ServerConfig, []Problem, error)
+	//Watch calls changed whenever the stored config changes, checking every interval until ctx is done
+	Watch(ctx context.Context, interval time.Duration, changed func())
 }
 
 //ServerConfig specfies how to connect to blob storage, and specfies users and their permissions
 type ServerConfig struct {
-	Users      []UserConfig `json:"users"`
-	StorageURL string       `json:"storage_url"`
+	Users      []UserConfig  `json:"users"`
+	StorageURL string        `json:"storage_url"`
+	Upload     *UploadConfig `json:"upload,omitempty"`
+	//StorageProfile is the AWS shared config profile used to open an s3 storage_url
+	StorageProfile string `json:"storage_profile,omitempty"`
+	//ACL rules are evaluated in order before falling back to the permissions of the user
+	ACL []ACLRule `json:"acl,omitempty"`
+	//UserCAKeys are the authorized_keys formatted CA keys whose user certificates are accepted
+	UserCAKeys []string `json:"user_ca_keys,omitempty"`
+	//RevokedKeys are refused whether they are CA keys, certificate keys or plain public keys
+	RevokedKeys []string `json:"revoked_keys,omitempty"`
+	//RevokedSerials are the serials of certificates that are refused
+	RevokedSerials []uint64 `json:"revoked_serials,omitempty"`
+	//AuthWebhook authenticates users with an http endpoint, which also decides their permissions and storage
+	AuthWebhook *AuthWebhookConfig `json:"auth_webhook,omitempty"`
+	//AllowedCIDRs are the networks clients may connect from, the server's --allow-cidr flags replace them
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+	//DeniedCIDRs are the networks clients may not connect from, the server's --deny-cidr flags replace them
+	DeniedCIDRs []string `json:"denied_cidrs,omitempty"`
 }
 
 //UserConfig specfies a user and their permissions
 type UserConfig struct {
-	UserName     string `json:"username"`
-	PasswordHash string `json:"password_hash"`
+	UserName     string        `json:"username"`
+	PasswordHash string        `json:"password_hash"`
+	Upload       *UploadConfig `json:"upload,omitempty"`
+	//Permissions lists what the user may do, such as "list", "read" or "write". Users without it may do anything
+	Permissions []string `json:"permissions,omitempty"`
+	//Groups the user belongs to, ACL rules can apply to groups
+	Groups []string `json:"groups,omitempty"`
+	//Mounts make up the user's file system instead of storage_url
+	Mounts []MountConfig `json:"mounts,omitempty"`
+	//StorageURL replaces the server's storage_url for the user, {{.User}} is replaced by the username
+	StorageURL string `json:"storage_url,omitempty"`
+	//StorageProfile is the AWS shared config profile used to open an s3 storage_url
+	StorageProfile string `json:"storage_profile,omitempty"`
+	//PublicKeys the user may sign in with
+	PublicKeys []PublicKeyConfig `json:"public_keys,omitempty"`
+	//TOTPSecret enables MFA, the user signs in with a password or key followed by a totp code
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	//Disabled users can't sign in, their config is kept
+	Disabled bool `json:"disabled,omitempty"`
+	//AllowedCIDRs are the IPv4 and IPv6 networks the user may sign in from, anywhere when empty
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
 }
 
-//ParseConfigSource takes a gocloud url, or file path, and returns a Provider
+//permissions returns the parsed permissions of the user
+func (u *UserConfig) permissions() (cloudfs.Permissions, error) {
+	if u.Permissions == nil {
+		return cloudfs.AllPermissions, nil
+	}
+	p, err := cloudfs.ParsePermissions(u.Permissions)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid permissions for user %v: %v", u.UserName, err)
+	}
+	return p, nil
+}
+
+//UploadConfig tunes how files are written to blob storage, unset values fall back to the server's settings
+type UploadConfig struct {
+	BufferSize  int `json:"buffer_size,omitempty"`
+	PartSize    int `json:"part_size,omitempty"`
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+func (u *UploadConfig) options() cloudfs.UploadOptions {
+	if u == nil {
+		return cloudfs.UploadOptions{}
+	}
+	return cloudfs.UploadOptions{
+		BufferSize:  u.BufferSize,
+		PartSize:    u.PartSize,
+		Concurrency: u.Concurrency,
+	}
+}
+
+//ParseConfigSource takes a gocloud url, or file path, and returns a Provider. The extension picks the format,
+//json, yaml, yml or toml.
 func ParseConfigSource(configSource string) (Provider, error) {
-	valid := false
-	for _, ext := range validFileExtensions {
+	var format configFormat
+	for ext, f := range validFileExtensions {
 		match := strings.HasSuffix(configSource, "."+ext)
 		if match {
-			valid = true
+			format = f
 			break
 		}
 	}
 
-	if !valid {
+	if format == nil {
 		return nil, fmt.Errorf("%v does not have a valid file extension", configSource)
 	}
 
@@ -63,15 +152,202 @@ func ParseConfigSource(configSource string) (Provider, error) {
 	}
 
 	if isGoCloudURL {
-		return newRemoteConfigProvider(configSource)
+		store, err := newRemoteConfigProvider(configSource)
+		if err != nil {
+			return nil, err
+		}
+		return &provider{store: store, format: format}, nil
 	}
 
-	return &local{
-		path: configSource,
+	return &provider{
+		store: &local{
+			path: configSource,
+		},
+		format: format,
 	}, nil
 }
 
-func passwordCallback(c *ServerConfig) server.PasswordCallback {
+//NewServerConfig builds a server.Config from the defaults and the settings in c
+func NewServerConfig(defaultConfig server.Config, c *ServerConfig) (*server.Config, error) {
+	return NewLoader().ServerConfig(defaultConfig, c)
+}
+
+//Loader builds the server.Config of each version of a config. The buckets opened for mounts and the
+//totp codes already used are kept from one version to the next, so a server reloading its config uses
+//a single Loader.
+type Loader struct {
+	pool     *bucketPool
+	verifier *totpVerifier
+}
+
+//NewLoader Creates a Loader
+func NewLoader() *Loader {
+	return &Loader{
+		pool:     newBucketPool(),
+		verifier: newTOTPVerifier(),
+	}
+}
+
+//ServerConfig builds a server.Config from the defaults and the settings in c
+func (l *Loader) ServerConfig(defaultConfig server.Config, c *ServerConfig) (*server.Config, error) {
+	serverConfig := defaultConfig
+	serverConfig.StorageURL = c.StorageURL
+	if len(c.AllowedCIDRs) != 0 {
+		serverConfig.AllowedCIDRs = c.AllowedCIDRs
+	}
+	if len(c.DeniedCIDRs) != 0 {
+		serverConfig.DeniedCIDRs = c.DeniedCIDRs
+	}
+	if _, err := server.ParseCIDRs(serverConfig.AllowedCIDRs); err != nil {
+		return nil, err
+	}
+	if _, err := server.ParseCIDRs(serverConfig.DeniedCIDRs); err != nil {
+		return nil, err
+	}
+	totpKeys, err := totpKeys(c)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := allowedSources(c)
+	if err != nil {
+		return nil, err
+	}
+	passwordCallback := passwordCallback(c)
+	serverConfig.PasswordCallback = func(cm ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		if err := checkSource(sources, cm); err != nil {
+			return nil, err
+		}
+		if !c.Allows(cm.User()) {
+			return nil, errors.New("incorrect username or password")
+		}
+		return nil, requireSecondFactor(totpKeys, passwordCallback(cm, password), cm.User())
+	}
+	publicKeyCallback, err := publicKeyCallback(c)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig.PublicKeyCallback = func(cm ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if err := checkSource(sources, cm); err != nil {
+			return nil, err
+		}
+		if !c.Allows(cm.User()) {
+			return nil, errors.New("unknown public key")
+		}
+		return nil, requireSecondFactor(totpKeys, publicKeyCallback(cm, key), cm.User())
+	}
+	serverConfig.SecondFactorCallback = secondFactorCallback(totpKeys, l.verifier)
+
+	upload := c.Upload.options().Merge(cloudfs.UploadOptions{
+		BufferSize:  defaultConfig.UploadBufferSize,
+		PartSize:    defaultConfig.UploadPartSize,
+		Concurrency: defaultConfig.UploadConcurrency,
+	})
+	serverConfig.UploadBufferSize = upload.BufferSize
+	serverConfig.UploadPartSize = upload.PartSize
+	serverConfig.UploadConcurrency = upload.Concurrency
+	serverConfig.UploadOptionsCallback = uploadOptionsCallback(c)
+
+	authorizerCallback, err := authorizerCallback(c)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig.AuthorizerCallback = authorizerCallback
+
+	if err := validateStorageURL(c.StorageURL); err != nil {
+		return nil, err
+	}
+	for i := range c.Users {
+		if err := validateStorageURL(c.Users[i].StorageURL); err != nil {
+			return nil, err
+		}
+		if err := validateMounts(&c.Users[i]); err != nil {
+			return nil, err
+		}
+	}
+	//a bucket callback set by the caller takes precedence over the storage urls of the config
+	prefixed := serverConfig.BucketCallback == nil
+	if prefixed {
+		serverConfig.BucketCallback = bucketCallback(c)
+	}
+	serverConfig.MountsCallback = mountsCallback(c, l.pool, prefixed)
+
+	if c.AuthWebhook != nil {
+		hook, err := newAuthWebhook(c)
+		if err != nil {
+			return nil, err
+		}
+		rules, err := compileACL(c.ACL)
+		if err != nil {
+			return nil, err
+		}
+		hook.wrap(&serverConfig, rules, l.pool)
+	}
+	return &serverConfig, nil
+}
+
+func authorizerCallback(c *ServerConfig) (server.AuthorizerCallback, error) {
+	rules, err := compileACL(c.ACL)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizers := map[string]cloudfs.Authorizer{}
+	for i := range c.Users {
+		u := &c.Users[i]
+		a, err := userAuthorizer(rules, u)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil {
+			authorizers[u.UserName] = a
+		}
+	}
+
+	return func(cm ssh.ConnMetadata) cloudfs.Authorizer {
+		return authorizers[cm.User()]
+	}, nil
+}
+
+//Allows reports whether username may sign in, which users removed from the config or disabled may not.
+//With an auth webhook the endpoint decides, so every username is allowed.
+func (c *ServerConfig) Allows(username string) bool {
+	if c.AuthWebhook != nil {
+		return true
+	}
+	u := c.findUser(username)
+	return u != nil && !u.Disabled
+}
+
+//userAuthorizer returns what u may do, or nil when u may do anything
+func userAuthorizer(rules []aclRule, u *UserConfig) (cloudfs.Authorizer, error) {
+	permissions, err := u.permissions()
+	if err != nil {
+		return nil, err
+	}
+	a := newACLAuthorizer(rules, u, permissions)
+	if len(a.rules) == 0 {
+		//users without rules or permissions may do anything
+		if permissions == cloudfs.AllPermissions {
+			return nil, nil
+		}
+		return permissions, nil
+	}
+	return a, nil
+}
+
+func uploadOptionsCallback(c *ServerConfig) server.UploadOptionsCallback {
+	return func(cm ssh.ConnMetadata) cloudfs.UploadOptions {
+		for _, u := range c.Users {
+			if u.UserName == cm.User() {
+				return u.Upload.options()
+			}
+		}
+		return cloudfs.UploadOptions{}
+	}
+}
+
+//passwordCallback checks the password of the users of c
+func passwordCallback(c *ServerConfig) func(cm ssh.ConnMetadata, password []byte) error {
 	return func(cm ssh.ConnMetadata, password []byte) error {
 		username := cm.User()
 
@@ -81,7 +357,6 @@ func passwordCallback(c *ServerConfig) server.PasswordCallback {
 				if len(u.PasswordHash) != 0 {
 					err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), password)
 					if err != nil {
-						fmt.Println(err)
 						return errors.New("incorrect username or password")
 					}
 
@@ -95,7 +370,6 @@ func passwordCallback(c *ServerConfig) server.PasswordCallback {
 			return nil
 		}
 
-		fmt.Println("Username not found")
-		return errors.New("incorrect username or Password")
+		return errors.New("incorrect username or password")
 	}
 }
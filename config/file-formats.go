@@ -0,0 +1,423 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+//configFormat decodes and encodes the config in a file format. Every format shares the schema of
+//the json tags of ServerConfig.
+type configFormat interface {
+	decode(d []byte, c *ServerConfig) error
+	//encode returns c in the format, keeping what it can of previous such as comments
+	encode(c *ServerConfig, previous []byte) ([]byte, error)
+	//tree returns d as yaml nodes, their lines are 0 when the format doesn't keep them
+	tree(d []byte) (*yaml.Node, error)
+}
+
+type jsonFormat struct{}
+
+func (jsonFormat) decode(d []byte, c *ServerConfig) error {
+	return json.Unmarshal(d, c)
+}
+
+func (jsonFormat) encode(c *ServerConfig, previous []byte) ([]byte, error) {
+	return json.MarshalIndent(c, "", "  ")
+}
+
+//fromGeneric decodes the maps, slices and values decoded by a yaml or toml parser into c
+func fromGeneric(v interface{}, c *ServerConfig) error {
+	d, err := json.Marshal(stringKeys(v))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, c)
+}
+
+//stringKeys converts the map[interface{}]interface{} some parsers produce so it can be encoded as json
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, value := range v {
+			m[fmt.Sprint(k)] = stringKeys(value)
+		}
+		return m
+	case map[string]interface{}:
+		for k, value := range v {
+			v[k] = stringKeys(value)
+		}
+		return v
+	case []map[string]interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			s[i] = stringKeys(value)
+		}
+		return s
+	case []interface{}:
+		for i, value := range v {
+			v[i] = stringKeys(value)
+		}
+		return v
+	}
+	return v
+}
+
+//tree decodes d with the yaml parser, which keeps the lines of json. The json parser checks d first
+//as it is stricter, and takes over if the yaml parser fails on json it doesn't support.
+func (jsonFormat) tree(d []byte) (*yaml.Node, error) {
+	var v interface{}
+	if err := json.Unmarshal(d, &v); err != nil {
+		return nil, err
+	}
+	var n yaml.Node
+	if err := yaml.Unmarshal(d, &n); err != nil {
+		return genericTree(v)
+	}
+	return &n, nil
+}
+
+//genericTree converts the maps, slices and values decoded by a parser to yaml nodes without lines
+func genericTree(v interface{}) (*yaml.Node, error) {
+	d, err := json.Marshal(stringKeys(v))
+	if err != nil {
+		return nil, err
+	}
+	var n yaml.Node
+	if err := yaml.Unmarshal(d, &n); err != nil {
+		return nil, err
+	}
+	clearLines(&n)
+	return &n, nil
+}
+
+func clearLines(n *yaml.Node) {
+	n.Line = 0
+	n.Column = 0
+	for _, child := range n.Content {
+		clearLines(child)
+	}
+}
+
+type yamlFormat struct{}
+
+func (yamlFormat) tree(d []byte) (*yaml.Node, error) {
+	var n yaml.Node
+	if err := yaml.Unmarshal(d, &n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (yamlFormat) decode(d []byte, c *ServerConfig) error {
+	var v interface{}
+	if err := yaml.Unmarshal(d, &v); err != nil {
+		return err
+	}
+	return fromGeneric(v, c)
+}
+
+//encode keeps the comments of previous on the keys and users that are still there
+func (yamlFormat) encode(c *ServerConfig, previous []byte) ([]byte, error) {
+	d, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	//json is yaml, decoding it as such keeps the order of the fields
+	var doc yaml.Node
+	if err := yaml.Unmarshal(d, &doc); err != nil {
+		return nil, err
+	}
+	blockStyle(&doc)
+
+	var old yaml.Node
+	if len(previous) != 0 && yaml.Unmarshal(previous, &old) == nil {
+		keepLayout(&old, &doc)
+	}
+
+	var b bytes.Buffer
+	e := yaml.NewEncoder(&b)
+	e.SetIndent(2)
+	if err := e.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+//blockStyle drops the flow style and quotes the nodes decoded from json have
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, child := range n.Content {
+		blockStyle(child)
+	}
+}
+
+//keepLayout copies the comments, flow style and key order of old to the matching nodes of n. Keys of mappings
+//match by name, users by username and other sequence items by position.
+func keepLayout(old *yaml.Node, n *yaml.Node) {
+	n.HeadComment = old.HeadComment
+	n.LineComment = old.LineComment
+	n.FootComment = old.FootComment
+	if old.Kind != n.Kind {
+		return
+	}
+	//a flow sequence or mapping stays on its line, so does the comment after it
+	n.Style |= old.Style & yaml.FlowStyle
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(old.Content) != 0 && len(n.Content) != 0 {
+			keepLayout(old.Content[0], n.Content[0])
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			oldKey, oldValue := mappingValue(old, key.Value)
+			if oldKey == nil {
+				continue
+			}
+			keepLayout(oldKey, key)
+			keepLayout(oldValue, value)
+			//the comment after a block sequence or mapping would be written on the line of the key following it
+			if value.Style&yaml.FlowStyle == 0 && (value.Kind == yaml.SequenceNode || value.Kind == yaml.MappingNode) && len(value.LineComment) != 0 {
+				if len(key.LineComment) == 0 {
+					key.LineComment = value.LineComment
+				}
+				value.LineComment = ""
+			}
+		}
+		//keys that were there keep their order, new keys follow them
+		content := make([]*yaml.Node, 0, len(n.Content))
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(old.Content); i += 2 {
+			if key, value := mappingValue(n, old.Content[i].Value); key != nil && !seen[key.Value] {
+				seen[key.Value] = true
+				content = append(content, key, value)
+			}
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if key, _ := mappingValue(old, n.Content[i].Value); key == nil {
+				content = append(content, n.Content[i], n.Content[i+1])
+			}
+		}
+		n.Content = content
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			if oldItem := sequenceItem(old, item, i); oldItem != nil {
+				keepLayout(oldItem, item)
+			}
+		}
+	}
+}
+
+//mappingValue returns the key and value nodes of key in the mapping n, or nils
+func mappingValue(n *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i], n.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+//sequenceItem returns the item of the sequence old matching item, the i'th item of the new sequence
+func sequenceItem(old *yaml.Node, item *yaml.Node, i int) *yaml.Node {
+	if _, username := mappingValue(item, "username"); username != nil {
+		for _, oldItem := range old.Content {
+			if _, oldUsername := mappingValue(oldItem, "username"); oldUsername != nil && oldUsername.Value == username.Value {
+				return oldItem
+			}
+		}
+		return nil
+	}
+	if i < len(old.Content) {
+		return old.Content[i]
+	}
+	return nil
+}
+
+//tomlFormat doesn't keep comments, the toml encoder can't write them
+type tomlFormat struct{}
+
+func (tomlFormat) decode(d []byte, c *ServerConfig) error {
+	var v map[string]interface{}
+	if err := toml.Unmarshal(d, &v); err != nil {
+		return err
+	}
+	return fromGeneric(v, c)
+}
+
+//tree converts the decoded document to yaml nodes, with the lines of the keys found from the order
+//the toml parser met them in
+func (tomlFormat) tree(d []byte) (*yaml.Node, error) {
+	var v map[string]interface{}
+	md, err := toml.Decode(string(d), &v)
+	if err != nil {
+		return nil, err
+	}
+	n, err := genericTree(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(n.Content) != 0 {
+		setLines(n.Content[0], nil, tomlLines(d, md))
+	}
+	return n, nil
+}
+
+//tomlHeader matches the header of a table or of an item of an array of tables
+var tomlHeader = regexp.MustCompile(`^\s*(\[\[?)([^\]]+)\]`)
+
+//tomlLines returns the line of each key of d by the path of its field. The parser gives the keys in
+//the order of the document, so each is looked for from the line of the one before.
+func tomlLines(d []byte, md toml.MetaData) map[string]int {
+	rows := strings.Split(string(d), "\n")
+	lines := map[string]int{}
+	//items is the index of the current item of each array of tables
+	items := map[string]int{}
+	row := 0
+	for _, key := range md.Keys() {
+		name := strings.Join(key, ".")
+		assignment := regexp.MustCompile(`(^|[{,])\s*("` + regexp.QuoteMeta(key[len(key)-1]) + `"|` + regexp.QuoteMeta(key[len(key)-1]) + `)\s*=`)
+		found := -1
+		array := false
+		for i := row; i < len(rows) && found < 0; i++ {
+			line := strings.TrimSpace(rows[i])
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			if m := tomlHeader.FindStringSubmatch(line); m != nil {
+				if strings.NewReplacer(" ", "", "\"", "").Replace(m[2]) == name {
+					found = i
+					array = m[1] == "[["
+				}
+				continue
+			}
+			if assignment.MatchString(line) {
+				found = i
+			}
+		}
+		if found < 0 {
+			continue
+		}
+		row = found
+
+		if array {
+			index, ok := items[name]
+			if ok {
+				index++
+			}
+			//the arrays of tables of the previous item start over
+			for other := range items {
+				if strings.HasPrefix(other, name+".") {
+					delete(items, other)
+				}
+			}
+			items[name] = index
+		}
+		path := fieldPath{}
+		for i := range key {
+			path = path.key(key[i])
+			if index, ok := items[strings.Join(key[:i+1], ".")]; ok {
+				path = path.index(index)
+			}
+		}
+		lines[path.String()] = found + 1
+		//the array itself is on the line of its first item
+		if array {
+			if _, ok := lines[path[:len(path)-1].String()]; !ok {
+				lines[path[:len(path)-1].String()] = found + 1
+			}
+		}
+	}
+	return lines
+}
+
+//setLines sets the lines of the keys, values and items of n from the lines of their paths
+func setLines(n *yaml.Node, path fieldPath, lines map[string]int) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			p := path.key(key.Value)
+			if line, ok := lines[p.String()]; ok {
+				key.Line = line
+				value.Line = line
+			}
+			setLines(value, p, lines)
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			p := path.index(i)
+			if line, ok := lines[p.String()]; ok {
+				item.Line = line
+			}
+			setLines(item, p, lines)
+		}
+	}
+}
+
+func (tomlFormat) encode(c *ServerConfig, previous []byte) ([]byte, error) {
+	d, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(d))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(tomlValue(v)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+//tomlValue converts the numbers of a value decoded from json to integers where it can, and drops
+//nulls toml has no way to write
+func tomlValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if value == nil {
+				delete(v, k)
+				continue
+			}
+			v[k] = tomlValue(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = tomlValue(value)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return u
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	}
+	return v
+}
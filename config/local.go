@@ -1,91 +1,51 @@
 package config
 
 import (
-	"encoding/json"
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
-
-	"golang.org/x/crypto/bcrypt"
-
-	"github.com/shidel-dev/cloud-sftp/server"
+	"path/filepath"
 )
 
+//local keeps the config in a file
 type local struct {
 	path string
 }
 
-func (l *local) ServerConfig(defaultConfig server.Config) (*server.Config, error) {
-
-	c, err := l.readConfigFile()
-	if err != nil {
-		return nil, err
-	}
-
-	return &server.Config{
-		Port:             defaultConfig.Port,
-		BindAddr:         defaultConfig.BindAddr,
-		HostKey:          defaultConfig.HostKey,
-		StorageURL:       c.StorageURL,
-		PasswordCallback: passwordCallback(c),
-	}, nil
+func (l *local) read() ([]byte, error) {
+	return ioutil.ReadFile(l.path)
 }
 
-func (l *local) AddUser(username string, password string, publicKey []byte) error {
-	c, err := l.readConfigFile()
+//write replaces the file with a temporary one written next to it, so a reload never reads a half
+//written config
+func (l *local) write(d []byte) error {
+	info, err := os.Stat(l.path)
 	if err != nil {
 		return err
 	}
-
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	f, err := ioutil.TempFile(filepath.Dir(l.path), "."+filepath.Base(l.path)+".*")
 	if err != nil {
 		return err
 	}
-	c.Users = append(c.Users, UserConfig{
-		UserName:     username,
-		PasswordHash: string(passwordHash),
-	})
+	defer os.Remove(f.Name())
 
-	return l.writeConfigFile(c)
-}
-
-func (l *local) readConfigFile() (*ServerConfig, error) {
-	jsonFile, err := os.Open(l.path)
-	if err != nil {
-		return nil, err
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Chmod(info.Mode())
 	}
-	defer jsonFile.Close()
-
-	jsonBytes, err := ioutil.ReadAll(jsonFile)
-	if err != nil {
-		return nil, err
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-
-	var c ServerConfig
-
-	err = json.Unmarshal(jsonBytes, &c)
-	if err != nil {
-		return nil, errors.New("Failed to parse config file")
-	}
-
-	return &c, nil
-}
-
-func (l *local) writeConfigFile(c *ServerConfig) error {
-	jsonFile, err := os.Open(l.path)
-	if err != nil {
-		return err
-	}
-	defer jsonFile.Close()
-	info, err := jsonFile.Stat()
-
 	if err != nil {
 		return err
 	}
+	return os.Rename(f.Name(), l.path)
+}
 
-	d, err := json.MarshalIndent(c, "", "  ")
+func (l *local) version() (string, error) {
+	info, err := os.Stat(l.path)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return ioutil.WriteFile(l.path, d, info.Mode())
+	return fmt.Sprintf("%v/%v", info.ModTime().UnixNano(), info.Size()), nil
 }
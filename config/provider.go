@@ -0,0 +1,332 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shidel-dev/cloud-sftp/server"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//configStore reads and writes the encoded config wherever it is kept
+type configStore interface {
+	read() ([]byte, error)
+	write(d []byte) error
+	//version changes whenever the stored config does
+	version() (string, error)
+}
+
+//provider implements Provider on top of a configStore
+type provider struct {
+	store  configStore
+	format configFormat
+}
+
+func (p *provider) ServerConfig(defaultConfig server.Config) (*server.Config, error) {
+	c, err := p.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServerConfig(defaultConfig, c)
+}
+
+//ReadConfig returns the decoded config
+func (p *provider) ReadConfig() (*ServerConfig, error) {
+	d, err := p.store.read()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.decode(d)
+}
+
+func (p *provider) decode(d []byte) (*ServerConfig, error) {
+	var c ServerConfig
+	err := p.format.decode(d, &c)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config file %v", err)
+	}
+
+	return &c, nil
+}
+
+//Validate reads the config and reports its problems, probe also checks that its buckets can be listed
+func (p *provider) Validate(probe bool) ([]Problem, error) {
+	d, err := p.store.read()
+	if err != nil {
+		return nil, err
+	}
+	return validate(p.format, d, probe), nil
+}
+
+func (p *provider) ReadValidConfig() (*ServerConfig, []Problem, error) {
+	d, err := p.store.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	if problems := validate(p.format, d, false); len(problems) != 0 {
+		return nil, problems, nil
+	}
+	c, err := p.decode(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, nil, nil
+}
+
+//Watch calls changed whenever the stored config changes, checking every interval until ctx is done
+func (p *provider) Watch(ctx context.Context, interval time.Duration, changed func()) {
+	last, err := p.store.version()
+	if err != nil {
+		log.Errorf("Failed to check the config version %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		v, err := p.store.version()
+		if err != nil {
+			log.Errorf("Failed to check the config version %v", err)
+			continue
+		}
+		if v != last {
+			last = v
+			changed()
+		}
+	}
+}
+
+//updateConfig reads the config, lets update change it and writes it back in the same format
+func (p *provider) updateConfig(update func(c *ServerConfig) error) error {
+	previous, err := p.store.read()
+	if err != nil {
+		return err
+	}
+	c, err := p.decode(previous)
+	if err != nil {
+		return err
+	}
+
+	if err := update(c); err != nil {
+		return err
+	}
+
+	d, err := p.format.encode(c, previous)
+	if err != nil {
+		return err
+	}
+	return p.store.write(d)
+}
+
+//findUser returns the user called username, or nil
+func (c *ServerConfig) findUser(username string) *UserConfig {
+	for i := range c.Users {
+		if c.Users[i].UserName == username {
+			return &c.Users[i]
+		}
+	}
+	return nil
+}
+
+//AddUser adds a user that signs in with password, publicKey or both. Either may be empty.
+func (p *provider) AddUser(username string, password string, publicKey []byte) error {
+	u := UserConfig{
+		UserName: username,
+	}
+
+	if len(password) != 0 {
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = string(passwordHash)
+	}
+
+	if len(publicKey) != 0 {
+		key := PublicKeyConfig{Key: string(publicKey)}
+		if _, err := parsePublicKey(key); err != nil {
+			return err
+		}
+		u.PublicKeys = append(u.PublicKeys, key)
+	}
+
+	return p.updateConfig(func(c *ServerConfig) error {
+		if c.findUser(username) != nil {
+			return fmt.Errorf("User %v already exists", username)
+		}
+		c.Users = append(c.Users, u)
+		return nil
+	})
+}
+
+//AddPublicKey authorizes another public key for an existing user
+func (p *provider) AddPublicKey(username string, key PublicKeyConfig) error {
+	parsed, err := parsePublicKey(key)
+	if err != nil {
+		return err
+	}
+
+	return p.updateConfig(func(c *ServerConfig) error {
+		u := c.findUser(username)
+		if u == nil {
+			return fmt.Errorf("Unknown user %v", username)
+		}
+		for _, existing := range u.PublicKeys {
+			other, err := parsePublicKey(existing)
+			if err == nil && other.matches(parsed.key) {
+				return fmt.Errorf("User %v already has this key", username)
+			}
+		}
+		u.PublicKeys = append(u.PublicKeys, key)
+		return nil
+	})
+}
+
+//EnrollMFA replaces the totp secret of a user with a new one
+func (p *provider) EnrollMFA(username string) (string, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = p.updateConfig(func(c *ServerConfig) error {
+		u := c.findUser(username)
+		if u == nil {
+			return fmt.Errorf("Unknown user %v", username)
+		}
+		u.TOTPSecret = secret
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+//ListUsers returns the users of the config
+func (p *provider) ListUsers() ([]UserConfig, error) {
+	c, err := p.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return c.Users, nil
+}
+
+//GetUser returns the user called username
+func (p *provider) GetUser(username string) (*UserConfig, error) {
+	c, err := p.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+	u := c.findUser(username)
+	if u == nil {
+		return nil, fmt.Errorf("Unknown user %v", username)
+	}
+	return u, nil
+}
+
+//updateUser lets update change the user called username
+func (p *provider) updateUser(username string, update func(c *ServerConfig, u *UserConfig) error) error {
+	return p.updateConfig(func(c *ServerConfig) error {
+		u := c.findUser(username)
+		if u == nil {
+			return fmt.Errorf("Unknown user %v", username)
+		}
+		return update(c, u)
+	})
+}
+
+//RemoveUser removes a user and their name from the ACL rules, so a user added later under the same
+//name doesn't get their grants. Rules left without users or groups are removed, as they would apply
+//to everyone.
+func (p *provider) RemoveUser(username string) error {
+	return p.updateConfig(func(c *ServerConfig) error {
+		for i := range c.Users {
+			if c.Users[i].UserName == username {
+				c.Users = append(c.Users[:i], c.Users[i+1:]...)
+				c.ACL = removeACLUser(c.ACL, username)
+				return nil
+			}
+		}
+		return fmt.Errorf("Unknown user %v", username)
+	})
+}
+
+//removeACLUser drops username from the users of rules, and the rules that only applied to them
+func removeACLUser(rules []ACLRule, username string) []ACLRule {
+	kept := rules[:0]
+	for _, rule := range rules {
+		if len(rule.Users) == 0 {
+			kept = append(kept, rule)
+			continue
+		}
+		var users []string
+		for _, u := range rule.Users {
+			if u != username {
+				users = append(users, u)
+			}
+		}
+		if len(users) == 0 && len(rule.Groups) == 0 {
+			continue
+		}
+		rule.Users = users
+		kept = append(kept, rule)
+	}
+	return kept
+}
+
+//SetPassword replaces the password of a user
+func (p *provider) SetPassword(username string, password string) error {
+	if len(password) == 0 {
+		return errors.New("Empty password")
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return p.updateUser(username, func(c *ServerConfig, u *UserConfig) error {
+		u.PasswordHash = string(passwordHash)
+		return nil
+	})
+}
+
+//SetDisabled disables or enables a user
+func (p *provider) SetDisabled(username string, disabled bool) error {
+	return p.updateUser(username, func(c *ServerConfig, u *UserConfig) error {
+		u.Disabled = disabled
+		return nil
+	})
+}
+
+//RenameUser renames a user along with the ACL rules naming them
+func (p *provider) RenameUser(username string, newUsername string) error {
+	if len(newUsername) == 0 {
+		return errors.New("Empty username")
+	}
+
+	return p.updateUser(username, func(c *ServerConfig, u *UserConfig) error {
+		if c.findUser(newUsername) != nil {
+			return fmt.Errorf("User %v already exists", newUsername)
+		}
+		u.UserName = newUsername
+		for i := range c.ACL {
+			for j := range c.ACL[i].Users {
+				if c.ACL[i].Users[j] == username {
+					c.ACL[i].Users[j] = newUsername
+				}
+			}
+		}
+		return nil
+	})
+}
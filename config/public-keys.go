@@ -0,0 +1,164 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//PublicKeyConfig is a public key a user may sign in with
+type PublicKeyConfig struct {
+	//Key is in the OpenSSH authorized_keys format, such as ssh-ed25519 AAAA... comment
+	Key     string `json:"key"`
+	Comment string `json:"comment,omitempty"`
+	//Options restrict the key as in authorized_keys. from="pattern-list" and expiry-time="YYYYMMDD[HHMM[SS]]"
+	//are enforced, the no-* and restrict options are accepted since the server never forwards anything.
+	Options []string `json:"options,omitempty"`
+	//Expires is when the key stops being accepted
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+//authorizedKey is a parsed PublicKeyConfig
+type authorizedKey struct {
+	key     ssh.PublicKey
+	comment string
+	from    []string
+	expires time.Time
+}
+
+func parsePublicKey(k PublicKeyConfig) (*authorizedKey, error) {
+	key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(k.Key))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key %q: %v", k.Key, err)
+	}
+
+	parsed := &authorizedKey{
+		key:     key,
+		comment: comment,
+	}
+	if len(k.Comment) != 0 {
+		parsed.comment = k.Comment
+	}
+	if k.Expires != nil {
+		parsed.expires = *k.Expires
+	}
+
+	for _, option := range append(options, k.Options...) {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], strings.Trim(option[i+1:], `"`)
+		}
+		switch strings.ToLower(name) {
+		case "from":
+			parsed.from = append(parsed.from, strings.Split(value, ",")...)
+		case "expiry-time":
+			expires, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid expiry-time %q of public key %v", value, parsed.comment)
+			}
+			if parsed.expires.IsZero() || expires.Before(parsed.expires) {
+				parsed.expires = expires
+			}
+		case "restrict":
+		default:
+			if !strings.HasPrefix(strings.ToLower(name), "no-") {
+				return nil, fmt.Errorf("Unsupported option %q of public key %v", name, parsed.comment)
+			}
+		}
+	}
+
+	return parsed, nil
+}
+
+//parseExpiryTime parses the YYYYMMDD[HHMM[SS]] format of the expiry-time option
+func parseExpiryTime(value string) (time.Time, error) {
+	switch len(value) {
+	case 8:
+		return time.ParseInLocation("20060102", value, time.Local)
+	case 12:
+		return time.ParseInLocation("200601021504", value, time.Local)
+	case 14:
+		return time.ParseInLocation("20060102150405", value, time.Local)
+	}
+	return time.Time{}, errors.New("Invalid expiry time")
+}
+
+func (k *authorizedKey) matches(key ssh.PublicKey) bool {
+	return bytes.Equal(k.key.Marshal(), key.Marshal())
+}
+
+//check returns an error if the key may not be used from addr at now
+func (k *authorizedKey) check(addr net.Addr, now time.Time) error {
+	if !k.expires.IsZero() && now.After(k.expires) {
+		return fmt.Errorf("public key %v expired at %v", k.comment, k.expires)
+	}
+	if len(k.from) != 0 && !matchFrom(k.from, addr) {
+		return fmt.Errorf("public key %v may not be used from %v", k.comment, addr)
+	}
+	return nil
+}
+
+//matchFrom matches the address of a connection against the patterns of a from option. Patterns
+//are CIDRs or addresses with * and ? wildcards, a pattern starting with ! rejects the addresses it
+//matches. Host names are not resolved.
+func matchFrom(patterns []string, addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			ok = ip != nil && network.Contains(ip)
+		} else {
+			ok, _ = path.Match(pattern, host)
+		}
+
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+//publicKeyCallback checks the public keys and certificates of the users of c
+func publicKeyCallback(c *ServerConfig) (func(cm ssh.ConnMetadata, key ssh.PublicKey) error, error) {
+	keys := map[string][]*authorizedKey{}
+	for _, u := range c.Users {
+		for _, k := range u.PublicKeys {
+			parsed, err := parsePublicKey(k)
+			if err != nil {
+				return nil, fmt.Errorf("User %v: %v", u.UserName, err)
+			}
+			keys[u.UserName] = append(keys[u.UserName], parsed)
+		}
+	}
+
+	checker, err := newCertChecker(c, func(cm ssh.ConnMetadata, key ssh.PublicKey) error {
+		for _, k := range keys[cm.User()] {
+			if !k.matches(key) {
+				continue
+			}
+			return k.check(cm.RemoteAddr(), time.Now())
+		}
+		return errors.New("unknown public key")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return checker.authenticate, nil
+}
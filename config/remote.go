@@ -1,18 +1,15 @@
 package config
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"net/url"
 
-	"github.com/shidel-dev/cloud-sftp/server"
+	"github.com/shidel-dev/cloud-sftp/cloudfs"
 	"gocloud.dev/blob"
-	"golang.org/x/crypto/bcrypt"
 )
 
+//remote keeps the config in a blob
 type remote struct {
 	key    string
 	bucket *blob.Bucket
@@ -36,74 +33,20 @@ func newRemoteConfigProvider(configSource string) (*remote, error) {
 	}, nil
 }
 
-func (r *remote) ServerConfig(defaultConfig server.Config) (*server.Config, error) {
-	c, err := r.readConfigFile()
-	if err != nil {
-		return nil, err
-	}
-
-	return &server.Config{
-		Port:             defaultConfig.Port,
-		BindAddr:         defaultConfig.BindAddr,
-		HostKey:          defaultConfig.HostKey,
-		StorageURL:       c.StorageURL,
-		PasswordCallback: passwordCallback(c),
-	}, nil
-}
-
-func (r *remote) AddUser(username string, password string, publicKey []byte) error {
-	c, err := r.readConfigFile()
-	if err != nil {
-		return err
-	}
-
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-	c.Users = append(c.Users, UserConfig{
-		UserName:     username,
-		PasswordHash: string(passwordHash),
-	})
-
-	return r.writeConfigFile(c)
+func (r *remote) read() ([]byte, error) {
+	return r.bucket.ReadAll(context.Background(), r.key)
 }
 
-func (r *remote) readConfigFile() (*ServerConfig, error) {
-	reader, err := r.bucket.NewReader(context.Background(), r.key, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	defer reader.Close()
-
-	p := make([]byte, 0)
-	buf := bytes.NewBuffer(p)
-
-	_, err = io.Copy(buf, reader)
-	if err != nil {
-		return nil, err
-	}
-
-	c := &ServerConfig{}
-	err = json.Unmarshal(p, c)
-	if err != nil {
-		return nil, err
-	}
-	return c, nil
+func (r *remote) write(d []byte) error {
+	return r.bucket.WriteAll(context.Background(), r.key, d, nil)
 }
 
-func (r *remote) writeConfigFile(c *ServerConfig) error {
-	d, err := json.MarshalIndent(c, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	writer, err := r.bucket.NewWriter(context.Background(), r.key, nil)
+//version uses the ETag of the blob, or its size, modification time and md5 for drivers that don't
+//expose one
+func (r *remote) version() (string, error) {
+	attrs, err := r.bucket.Attributes(context.Background(), r.key)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer writer.Close()
-
-	return r.bucket.WriteAll(context.Background(), r.key, d, nil)
+	return cloudfs.BlobETag(attrs), nil
 }
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//Schema returns the JSON Schema of ServerConfig, which is generated from its json tags so it can't
+//fall behind the structs
+func Schema() map[string]interface{} {
+	s := typeSchema(reflect.TypeOf(ServerConfig{}))
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["title"] = "cloud-sftp config"
+	return s
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			name := jsonName(t.Field(i))
+			if len(name) != 0 {
+				properties[name] = typeSchema(t.Field(i).Type)
+			}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+//jsonName returns the name of the field in the json tag, or an empty string for skipped fields
+func jsonName(f reflect.StructField) string {
+	if len(f.PkgPath) != 0 {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if len(name) == 0 {
+		return f.Name
+	}
+	return name
+}
+
+//checkSchema reports the nodes of n that don't match schema, which is the subset of JSON Schema
+//generated by Schema
+func checkSchema(schema map[string]interface{}, n *yaml.Node, path fieldPath, problems *[]Problem) {
+	if n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return
+	}
+
+	problem := func(format string, args ...interface{}) {
+		*problems = append(*problems, Problem{Line: n.Line, Field: path.String(), Message: fmt.Sprintf(format, args...)})
+	}
+	kind := nodeKind(n)
+
+	switch schema["type"] {
+	case "object":
+		if n.Kind != yaml.MappingNode {
+			problem("Expected an object, not %v", kind)
+			return
+		}
+		properties := schema["properties"].(map[string]interface{})
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			property, ok := properties[key.Value]
+			if !ok {
+				*problems = append(*problems, Problem{Line: key.Line, Field: path.String(), Message: fmt.Sprintf("Unknown field %q", key.Value)})
+				continue
+			}
+			checkSchema(property.(map[string]interface{}), value, path.key(key.Value), problems)
+		}
+	case "array":
+		if n.Kind != yaml.SequenceNode {
+			problem("Expected a list, not %v", kind)
+			return
+		}
+		for i, item := range n.Content {
+			checkSchema(schema["items"].(map[string]interface{}), item, path.index(i), problems)
+		}
+	case "string":
+		if schema["format"] == "date-time" {
+			if n.Tag == "!!timestamp" {
+				return
+			}
+			if _, err := time.Parse(time.RFC3339, n.Value); n.Tag == "!!str" && err != nil {
+				problem("Expected a date and time such as 2006-01-02T15:04:05Z, not %q", n.Value)
+				return
+			}
+		}
+		if n.Tag != "!!str" {
+			problem("Expected a string, not %v", kind)
+		}
+	case "boolean":
+		if n.Tag != "!!bool" {
+			problem("Expected true or false, not %v", kind)
+		}
+	case "integer":
+		if n.Tag != "!!int" {
+			problem("Expected an integer, not %v", kind)
+		} else if _, ok := schema["minimum"]; ok && strings.HasPrefix(n.Value, "-") {
+			problem("Expected a positive integer, not %v", n.Value)
+		}
+	case "number":
+		if n.Tag != "!!int" && n.Tag != "!!float" {
+			problem("Expected a number, not %v", kind)
+		}
+	}
+}
+
+//nodeKind describes what n holds for problems
+func nodeKind(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "an object"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	switch n.Tag {
+	case "!!str":
+		return "a string"
+	case "!!int":
+		return "an integer"
+	case "!!float":
+		return "a number"
+	case "!!bool":
+		return "a boolean"
+	case "!!timestamp":
+		return "a timestamp"
+	}
+	return n.Tag
+}
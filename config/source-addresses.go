@@ -0,0 +1,36 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/shidel-dev/cloud-sftp/server"
+	"golang.org/x/crypto/ssh"
+)
+
+//allowedSources returns the parsed allowed_cidrs of the users having them
+func allowedSources(c *ServerConfig) (map[string][]*net.IPNet, error) {
+	sources := map[string][]*net.IPNet{}
+	for _, u := range c.Users {
+		if len(u.AllowedCIDRs) == 0 {
+			continue
+		}
+		networks, err := server.ParseCIDRs(u.AllowedCIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("User %v: %v", u.UserName, err)
+		}
+		sources[u.UserName] = networks
+	}
+	return sources, nil
+}
+
+//checkSource refuses users signing in from outside their allowed networks. It is checked before the
+//credentials and fails like a wrong password, so it doesn't tell whether they were correct.
+func checkSource(sources map[string][]*net.IPNet, cm ssh.ConnMetadata) error {
+	networks, ok := sources[cm.User()]
+	if ok && !server.ContainsAddr(networks, cm.RemoteAddr()) {
+		return errors.New("incorrect username or password")
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/shidel-dev/cloud-sftp/server"
+	gcaws "gocloud.dev/aws"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/s3blob"
+	"golang.org/x/crypto/ssh"
+)
+
+//storageURLData is what storage urls are templated with, such as s3://partner-{{.User}}
+type storageURLData struct {
+	User string
+}
+
+func parseStorageURL(storageURL string) (*template.Template, error) {
+	t, err := template.New("storage_url").Parse(storageURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid storage url %v: %v", storageURL, err)
+	}
+	return t, nil
+}
+
+//validateStorageURL checks that a storage url is a valid template
+func validateStorageURL(storageURL string) error {
+	_, err := expandStorageURL(storageURL, "user")
+	return err
+}
+
+//storageURLUsername matches the usernames that can be put in a storage url as they are, others could
+//change its host, path or query
+var storageURLUsername = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+//expandStorageURL fills in the template of a storage url for username
+func expandStorageURL(storageURL string, username string) (string, error) {
+	t, err := parseStorageURL(storageURL)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(storageURL, "{{") && (!storageURLUsername.MatchString(username) || username == "." || username == "..") {
+		return "", fmt.Errorf("Username %q can't be used in storage url %v, it may only contain letters, digits, ., _ and -", username, storageURL)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, storageURLData{User: username}); err != nil {
+		return "", fmt.Errorf("Invalid storage url %v: %v", storageURL, err)
+	}
+	return buf.String(), nil
+}
+
+//openStorage opens the bucket at storageURL. When profile is set the credentials of that AWS shared
+//config profile are used, which is only supported for s3 urls.
+func openStorage(ctx context.Context, storageURL string, profile string) (*blob.Bucket, error) {
+	if len(profile) == 0 {
+		return blob.OpenBucket(ctx, storageURL)
+	}
+
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" {
+		return nil, fmt.Errorf("storage_profile is only supported for s3 urls, not %v", storageURL)
+	}
+
+	cfg, err := gcaws.ConfigFromURLParams(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s3blob.OpenBucket(ctx, sess, u.Host, nil)
+}
+
+//userStorageURL returns the storage url and profile of u, or the server's ones for users without their own
+func userStorageURL(c *ServerConfig, u *UserConfig) (string, string) {
+	if len(u.StorageURL) != 0 {
+		return u.StorageURL, u.StorageProfile
+	}
+	return c.StorageURL, c.StorageProfile
+}
+
+//bucketCallback opens the storage url of the user, or the server's one for users without their own
+func bucketCallback(c *ServerConfig) server.BucketCallback {
+	return func(cm ssh.ConnMetadata) (*blob.Bucket, error) {
+		u := &UserConfig{UserName: cm.User()}
+		for i := range c.Users {
+			if c.Users[i].UserName == cm.User() {
+				u = &c.Users[i]
+			}
+		}
+		storageURL, profile := userStorageURL(c, u)
+		if len(storageURL) == 0 {
+			return nil, errors.New("Missing storage url")
+		}
+
+		expanded, err := expandStorageURL(storageURL, cm.User())
+		if err != nil {
+			return nil, err
+		}
+		return openStorage(context.Background(), expanded, profile)
+	}
+}
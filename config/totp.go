@@ -0,0 +1,152 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shidel-dev/cloud-sftp/server"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	//totpSkew is the number of periods a code may be ahead or behind the server's clock
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//newTOTPSecret returns a random base32 encoded secret
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return nil, errors.New("Invalid totp secret")
+	}
+	return key, nil
+}
+
+//totpCode returns the RFC 6238 code of key for counter
+func totpCode(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+//TOTPCode returns the code of a base32 encoded secret at t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, uint64(t.Unix()/totpPeriod)), nil
+}
+
+//TOTPURI returns the otpauth uri authenticator apps enroll secret from
+func TOTPURI(issuer string, username string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("period", fmt.Sprint(totpPeriod))
+	v.Set("digits", fmt.Sprint(totpDigits))
+	return fmt.Sprintf("otpauth://totp/%v:%v?%v", url.PathEscape(issuer), url.PathEscape(username), v.Encode())
+}
+
+//totpVerifier checks codes, each code is only accepted once per user
+type totpVerifier struct {
+	mu sync.Mutex
+	//used is the counter of the last code accepted for each user
+	used map[string]uint64
+	now  func() time.Time
+}
+
+func newTOTPVerifier() *totpVerifier {
+	return &totpVerifier{
+		used: map[string]uint64{},
+		now:  time.Now,
+	}
+}
+
+func (v *totpVerifier) verify(username string, key []byte, code string) bool {
+	code = strings.TrimSpace(code)
+	current := uint64(v.now().Unix() / totpPeriod)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if !hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			continue
+		}
+		//a code, or one older than the last accepted, can't be replayed
+		if last, ok := v.used[username]; ok && counter <= last {
+			return false
+		}
+		v.used[username] = counter
+		return true
+	}
+	return false
+}
+
+//totpKeys returns the decoded totp secrets of the users with MFA enabled
+func totpKeys(c *ServerConfig) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	for _, u := range c.Users {
+		if len(u.TOTPSecret) == 0 {
+			continue
+		}
+		key, err := decodeTOTPSecret(u.TOTPSecret)
+		if err != nil {
+			return nil, fmt.Errorf("User %v: %v", u.UserName, err)
+		}
+		keys[u.UserName] = key
+	}
+	return keys, nil
+}
+
+//requireSecondFactor asks users with MFA enabled for a totp code once their first factor is correct
+func requireSecondFactor(keys map[string][]byte, err error, username string) error {
+	if _, ok := keys[username]; ok && err == nil {
+		return server.ErrSecondFactorRequired
+	}
+	return err
+}
+
+func secondFactorCallback(keys map[string][]byte, verifier *totpVerifier) server.KeyboardInteractiveCallback {
+	return func(cm ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		key, ok := keys[cm.User()]
+		if !ok {
+			return nil, errors.New("mfa is not enabled")
+		}
+		answers, err := client("", "", []string{"Verification code: "}, []bool{true})
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) != 1 || !verifier.verify(cm.User(), key, answers[0]) {
+			return nil, errors.New("incorrect verification code")
+		}
+		return nil, nil
+	}
+}
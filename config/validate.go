@@ -0,0 +1,386 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/shidel-dev/cloud-sftp/server"
+	"gocloud.dev/blob"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+//probeTimeout bounds opening and listing each bucket when probing storage
+const probeTimeout = 10 * time.Second
+
+//Problem is something wrong with a config
+type Problem struct {
+	//Line is 0 when the format doesn't tell where the problem is
+	Line int `json:"line,omitempty"`
+	//Field is the path of the field with the problem, such as users[2].password_hash
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	s := p.Message
+	if len(p.Field) != 0 {
+		s = p.Field + ": " + s
+	}
+	if p.Line != 0 {
+		s = fmt.Sprintf("line %v: %v", p.Line, s)
+	}
+	return s
+}
+
+//fieldPath is the keys and indexes leading to a field of the config
+type fieldPath []interface{}
+
+func (p fieldPath) key(k string) fieldPath {
+	return append(p[:len(p):len(p)], k)
+}
+
+func (p fieldPath) index(i int) fieldPath {
+	return append(p[:len(p):len(p)], i)
+}
+
+func (p fieldPath) String() string {
+	s := ""
+	for _, part := range p {
+		switch part := part.(type) {
+		case int:
+			s += fmt.Sprintf("[%v]", part)
+		default:
+			if len(s) != 0 {
+				s += "."
+			}
+			s += fmt.Sprint(part)
+		}
+	}
+	return s
+}
+
+//line returns the line of the field in root, or of the closest parent that is there
+func (p fieldPath) line(root *yaml.Node) int {
+	n := root
+	line := root.Line
+	for _, part := range p {
+		var next *yaml.Node
+		switch part := part.(type) {
+		case int:
+			if n.Kind == yaml.SequenceNode && part < len(n.Content) {
+				next = n.Content[part]
+			}
+		case string:
+			key, value := mappingValue(n, part)
+			if key != nil {
+				line = key.Line
+				next = value
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+		if n.Kind != yaml.MappingNode && n.Kind != yaml.SequenceNode || n.Line != 0 {
+			line = n.Line
+		}
+	}
+	return line
+}
+
+//problems collects the problems of a config
+type problems struct {
+	root *yaml.Node
+	list []Problem
+}
+
+func (p *problems) add(path fieldPath, err error) {
+	p.list = append(p.list, Problem{Line: path.line(p.root), Field: path.String(), Message: err.Error()})
+}
+
+//validate reports every problem of the encoded config d. probe also checks that each bucket of the
+//config can be listed.
+func validate(format configFormat, d []byte, probe bool) []Problem {
+	tree, err := format.tree(d)
+	if err != nil {
+		return []Problem{syntaxProblem(err, d)}
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if tree.Kind == yaml.DocumentNode && len(tree.Content) != 0 {
+		root = tree.Content[0]
+	}
+
+	p := &problems{root: root}
+	checkSchema(Schema(), root, nil, &p.list)
+
+	//unknown fields don't keep the rest from being checked, values of the wrong type do
+	var c ServerConfig
+	if err := format.decode(d, &c); err != nil {
+		if len(p.list) == 0 {
+			p.list = append(p.list, Problem{Message: err.Error()})
+		}
+		return p.list
+	}
+	checkConfig(&c, p)
+	if len(p.list) != 0 {
+		return p.list
+	}
+
+	//whatever is left that the server would refuse
+	if _, err := NewServerConfig(server.Config{}, &c); err != nil {
+		p.add(nil, err)
+		return p.list
+	}
+
+	if probe {
+		probeStorage(&c, p)
+	}
+	return p.list
+}
+
+//syntaxProblem returns the problem of a config that failed to parse, with the line where the parser
+//tells it
+func syntaxProblem(err error, d []byte) Problem {
+	problem := Problem{Message: err.Error()}
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		problem.Line = 1 + strings.Count(string(d[:err.Offset]), "\n")
+	case *json.UnmarshalTypeError:
+		problem.Line = 1 + strings.Count(string(d[:err.Offset]), "\n")
+	case toml.ParseError:
+		problem.Line = err.Position.Line
+		//the message starts with the line as well
+		message := strings.TrimPrefix(problem.Message, "toml: ")
+		if i := strings.Index(message, ": "); strings.HasPrefix(message, "line ") && i >= 0 {
+			problem.Message = message[i+2:]
+		}
+	default:
+		var line int
+		if n, _ := fmt.Sscanf(problem.Message, "yaml: line %d:", &line); n == 1 {
+			problem.Line = line
+			problem.Message = strings.TrimSpace(strings.SplitN(problem.Message, ":", 3)[2])
+		}
+	}
+	return problem
+}
+
+//checkConfig reports the values the schema allows but the server can't use
+func checkConfig(c *ServerConfig, p *problems) {
+	checkStorageURL(c.StorageURL, c.StorageProfile, fieldPath{"storage_url"}, p)
+	checkCIDRs(c.AllowedCIDRs, fieldPath{"allowed_cidrs"}, p)
+	checkCIDRs(c.DeniedCIDRs, fieldPath{"denied_cidrs"}, p)
+	checkKeys(c.UserCAKeys, fieldPath{"user_ca_keys"}, p)
+	checkKeys(c.RevokedKeys, fieldPath{"revoked_keys"}, p)
+	if _, err := compileACL(c.ACL); err != nil {
+		p.add(fieldPath{"acl"}, err)
+	}
+	if c.AuthWebhook != nil {
+		if _, err := newAuthWebhook(c); err != nil {
+			p.add(fieldPath{"auth_webhook", "url"}, err)
+		}
+	}
+
+	checkConcurrency(c.Upload, []string{c.StorageURL}, fieldPath{"upload"}, p)
+
+	usernames := map[string]int{}
+	for i := range c.Users {
+		u := &c.Users[i]
+		path := fieldPath{"users"}.index(i)
+		storageURLs := []string{u.StorageURL}
+		if len(u.StorageURL) == 0 {
+			storageURLs = []string{c.StorageURL}
+		}
+		if len(u.Mounts) != 0 {
+			storageURLs = storageURLs[:0]
+			for _, m := range u.Mounts {
+				storageURLs = append(storageURLs, m.StorageURL)
+			}
+		}
+		checkConcurrency(u.Upload, storageURLs, path.key("upload"), p)
+		if len(u.UserName) == 0 {
+			p.add(path.key("username"), errors.New("Missing username"))
+		} else if first, ok := usernames[u.UserName]; ok {
+			p.add(path.key("username"), fmt.Errorf("Duplicate username %v, it is also users[%v]", u.UserName, first))
+		} else {
+			usernames[u.UserName] = i
+		}
+
+		if len(u.PasswordHash) != 0 {
+			if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+				p.add(path.key("password_hash"), fmt.Errorf("Malformed bcrypt hash: %v", err))
+			}
+		}
+		if _, err := u.permissions(); err != nil {
+			p.add(path.key("permissions"), err)
+		}
+		for j, k := range u.PublicKeys {
+			if _, err := parsePublicKey(k); err != nil {
+				p.add(path.key("public_keys").index(j), err)
+			}
+		}
+		if len(u.TOTPSecret) != 0 {
+			if _, err := decodeTOTPSecret(u.TOTPSecret); err != nil {
+				p.add(path.key("totp_secret"), err)
+			}
+		}
+		checkCIDRs(u.AllowedCIDRs, path.key("allowed_cidrs"), p)
+		checkStorageURL(u.StorageURL, u.StorageProfile, path.key("storage_url"), p)
+
+		mounts := map[string]int{}
+		for j, m := range u.Mounts {
+			mountPath := path.key("mounts").index(j)
+			if !strings.HasPrefix(m.Path, "/") {
+				p.add(mountPath.key("path"), fmt.Errorf("Mount path %v must start with /", m.Path))
+			} else if first, ok := mounts[m.Path]; ok {
+				p.add(mountPath.key("path"), fmt.Errorf("Duplicate mount path %v, it is also mounts[%v]", m.Path, first))
+			} else {
+				mounts[m.Path] = j
+			}
+			if len(m.StorageURL) == 0 {
+				p.add(mountPath.key("storage_url"), errors.New("Missing storage url"))
+			}
+			checkStorageURL(m.StorageURL, m.StorageProfile, mountPath.key("storage_url"), p)
+		}
+	}
+}
+
+//checkStorageURL reports a storage url that isn't a valid template, doesn't parse or has a scheme
+//without a registered driver
+func checkStorageURL(storageURL string, profile string, path fieldPath, p *problems) {
+	if len(storageURL) == 0 {
+		return
+	}
+	expanded, err := expandStorageURL(storageURL, "user")
+	if err != nil {
+		p.add(path, err)
+		return
+	}
+	u, err := url.Parse(expanded)
+	if err != nil {
+		p.add(path, fmt.Errorf("Invalid storage url %v: %v", storageURL, err))
+		return
+	}
+	if len(u.Scheme) == 0 {
+		p.add(path, fmt.Errorf("Invalid storage url %v: missing scheme such as s3://", storageURL))
+		return
+	}
+	if !blob.DefaultURLMux().ValidBucketScheme(u.Scheme) {
+		p.add(path, fmt.Errorf("Unsupported storage url scheme %v, supported are %v", u.Scheme, strings.Join(blob.DefaultURLMux().BucketSchemes(), ", ")))
+		return
+	}
+	if len(profile) != 0 && u.Scheme != "s3" {
+		p.add(path, fmt.Errorf("storage_profile is only supported for s3 urls, not %v", storageURL))
+	}
+}
+
+//checkConcurrency reports an upload concurrency for storage that is only s3, whose driver doesn't let
+//it be set
+func checkConcurrency(upload *UploadConfig, storageURLs []string, path fieldPath, p *problems) {
+	if upload == nil || upload.Concurrency == 0 || !isS3(storageURLs) {
+		return
+	}
+	p.add(path.key("concurrency"), errors.New("Upload concurrency only applies to Azure, the S3 driver always uploads 5 parts in parallel"))
+}
+
+//isS3 reports whether every storage url is an s3 url
+func isS3(storageURLs []string) bool {
+	for _, storageURL := range storageURLs {
+		if !strings.HasPrefix(storageURL, "s3://") {
+			return false
+		}
+	}
+	return len(storageURLs) != 0
+}
+
+func checkCIDRs(cidrs []string, path fieldPath, p *problems) {
+	for i, cidr := range cidrs {
+		if _, err := server.ParseCIDRs([]string{cidr}); err != nil {
+			p.add(path.index(i), err)
+		}
+	}
+}
+
+func checkKeys(keys []string, path fieldPath, p *problems) {
+	for i, k := range keys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err != nil {
+			p.add(path.index(i), fmt.Errorf("Invalid key: %v", err))
+		}
+	}
+}
+
+//probeStorage reports the buckets of the config that can't be opened and listed. Templated urls are
+//probed for every user they apply to.
+func probeStorage(c *ServerConfig, p *problems) {
+	type target struct {
+		path       fieldPath
+		storageURL string
+		profile    string
+		username   string
+	}
+	targets := []target{}
+	if len(c.StorageURL) != 0 && !strings.Contains(c.StorageURL, "{{") {
+		targets = append(targets, target{fieldPath{"storage_url"}, c.StorageURL, c.StorageProfile, ""})
+	}
+	for i, u := range c.Users {
+		path := fieldPath{"users"}.index(i)
+		switch {
+		case len(u.Mounts) != 0:
+			for j, m := range u.Mounts {
+				targets = append(targets, target{path.key("mounts").index(j).key("storage_url"), m.StorageURL, m.StorageProfile, u.UserName})
+			}
+		case len(u.StorageURL) != 0:
+			targets = append(targets, target{path.key("storage_url"), u.StorageURL, u.StorageProfile, u.UserName})
+		case strings.Contains(c.StorageURL, "{{"):
+			targets = append(targets, target{fieldPath{"storage_url"}, c.StorageURL, c.StorageProfile, u.UserName})
+		}
+	}
+
+	probed := map[string]bool{}
+	for _, t := range targets {
+		storageURL, err := expandStorageURL(t.storageURL, t.username)
+		if err != nil {
+			p.add(t.path, err)
+			continue
+		}
+		bucketURL, prefix, err := splitStorageURL(storageURL)
+		if err != nil {
+			p.add(t.path, err)
+			continue
+		}
+		id := t.profile + "\x00" + bucketURL + "\x00" + prefix
+		if probed[id] {
+			continue
+		}
+		probed[id] = true
+		if err := probeBucket(bucketURL, prefix, t.profile); err != nil {
+			p.add(t.path, fmt.Errorf("Unreachable bucket %v: %v", storageURL, err))
+		}
+	}
+}
+
+func probeBucket(bucketURL string, prefix string, profile string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	bucket, err := openStorage(ctx, bucketURL, profile)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+	_, err = bucket.List(&blob.ListOptions{Prefix: prefix, Delimiter: "/"}).Next(ctx)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -3,28 +3,44 @@ package main
 import (
 	"bytes"
 	"context"
+	crand "crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/google/uuid"
+	"github.com/shidel-dev/cloud-sftp/cloudfs"
 	"github.com/shidel-dev/cloud-sftp/config"
 	"gocloud.dev/blob"
+	"gocloud.dev/blob/driver"
 	"gocloud.dev/blob/s3blob"
+	"gocloud.dev/gcerrors"
 
 	"github.com/pkg/sftp"
 	"github.com/shidel-dev/cloud-sftp/server"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -42,9 +58,59 @@ func TestE2EFile(t *testing.T) {
 	if err != nil {
 		t.Fatal("Could not create sftp-test dir")
 	}
+	for _, dir := range []string{"/tmp/sftp-archive", "/tmp/sftp-inbox", "/tmp/sftp-tenant"} {
+		_ = os.RemoveAll(path.Join(wd, dir))
+		if err := os.MkdirAll(path.Join(wd, dir), 0700); err != nil {
+			t.Fatalf("Could not create %v dir", dir)
+		}
+	}
+
+	partnerPasswordHash, err := bcrypt.GenerateFromPassword([]byte("partnerpassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal("Failed to hash partner password")
+	}
+
+	caSigner, err := newTestSigner()
+	if err != nil {
+		t.Fatalf("Failed to generate CA key %v", err)
+	}
 
 	c := config.ServerConfig{
-		StorageURL: fmt.Sprintf("file://%v", tmpDir),
+		StorageURL:     fmt.Sprintf("file://%v", tmpDir),
+		UserCAKeys:     []string{string(ssh.MarshalAuthorizedKey(caSigner.PublicKey()))},
+		RevokedSerials: []uint64{13},
+		Users: []config.UserConfig{{
+			UserName:     "dropbox",
+			PasswordHash: string(partnerPasswordHash),
+			Permissions:  []string{"write"},
+			Groups:       []string{"partners"},
+		}, {
+			UserName:     "mounted",
+			PasswordHash: string(partnerPasswordHash),
+			Mounts: []config.MountConfig{
+				{Path: "/archive", StorageURL: fmt.Sprintf("file://%v", path.Join(wd, "/tmp/sftp-archive"))},
+				{Path: "/inbox", StorageURL: fmt.Sprintf("file://%v", path.Join(wd, "/tmp/sftp-inbox"))},
+			},
+		}, {
+			UserName:     "tenant",
+			PasswordHash: string(partnerPasswordHash),
+			StorageURL:   fmt.Sprintf("file://%v", path.Join(wd, "/tmp/sftp-{{.User}}")),
+		}, {
+			UserName: "certuser",
+		}, {
+			UserName:     "restricted",
+			PasswordHash: string(partnerPasswordHash),
+			AllowedCIDRs: []string{"203.0.113.0/24", "2001:db8::/32"},
+		}, {
+			UserName:     "local",
+			PasswordHash: string(partnerPasswordHash),
+			AllowedCIDRs: []string{"127.0.0.0/8", "::1/128"},
+		}},
+		ACL: []config.ACLRule{{
+			Path:   "/outgoing/**",
+			Allow:  []string{"list", "read"},
+			Groups: []string{"partners"},
+		}},
 	}
 	d, err := json.Marshal(&c)
 	if err != nil {
@@ -65,6 +131,24 @@ func TestE2EFile(t *testing.T) {
 		t.Fatalf("Failed to add user %v", err)
 	}
 
+	keySigner, err := newTestSigner()
+	if err != nil {
+		t.Fatalf("Failed to generate key %v", err)
+	}
+	err = provider.AddUser("keyuser", "", ssh.MarshalAuthorizedKey(keySigner.PublicKey()))
+	if err != nil {
+		t.Fatalf("Failed to add key user %v", err)
+	}
+
+	err = provider.AddUser("mfauser", "partnerpassword", []byte{})
+	if err != nil {
+		t.Fatalf("Failed to add mfa user %v", err)
+	}
+	totpSecret, err := provider.EnrollMFA("mfauser")
+	if err != nil {
+		t.Fatalf("Failed to enroll mfa user %v", err)
+	}
+
 	privateBytes, err := ioutil.ReadFile("testdata/id_rsa")
 	if err != nil {
 		log.Fatal("Failed to load private key", err)
@@ -76,9 +160,19 @@ func TestE2EFile(t *testing.T) {
 	}
 
 	defaultConfig := server.Config{
-		HostKey:  private,
-		BindAddr: "0.0.0.0",
-		Port:     2022,
+		HostKey:       private,
+		BindAddr:      "0.0.0.0",
+		Port:          2022,
+		CacheDir:      path.Join(wd, "/tmp/sftp-cache"),
+		CacheMaxBytes: 256 << 10,
+		//large_file.txt is too big for the cache, so its download is prefetched
+		PrefetchChunkSize: 64 << 10,
+		PrefetchMinSize:   128 << 10,
+		SpillDir:          path.Join(wd, "/tmp/sftp-spill"),
+		ReorderWindow:     8,
+		//the examples fail to sign in on purpose more often than the default allows
+		MaxAuthFailures:  20,
+		AuthFailureDelay: -1,
 	}
 	config, err := provider.ServerConfig(defaultConfig)
 	if err != nil {
@@ -111,269 +205,1498 @@ func TestE2EFile(t *testing.T) {
 	}
 
 	runSharedExamples(t, client)
-	fmt.Println("File finished")
-}
 
-func TestE2EMinio(t *testing.T) {
-	sess, err := session.NewSession(&aws.Config{
-		Credentials:      credentials.NewStaticCredentials("minio", "miniosecret", ""),
-		Region:           aws.String("us-west-1"),
-		Endpoint:         aws.String("localhost:9000"),
-		DisableSSL:       aws.Bool(true),
-		S3ForcePathStyle: aws.Bool(true),
+	//a first read is served by the bucket while the cache fills in the background, later reads hit it
+	if _, err = writeStrToRemoteFile(client, "cached.txt", "Cached"); err != nil {
+		t.Fatalf("Failed to write cached.txt err: %v", err)
+	}
+	hits := cloudfs.Stats().Hits
+	for deadline := time.Now().Add(5 * time.Second); cloudfs.Stats().Hits == hits; time.Sleep(10 * time.Millisecond) {
+		if str, err := readStrFromRemoteFile(client, "cached.txt"); err != nil || str != "Cached" {
+			t.Fatalf("Expected cached.txt to eq 'Cached' not %q err: %v", str, err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected cached.txt to be read from the cache once it was filled")
+		}
+	}
+	if err = client.Remove("cached.txt"); err != nil {
+		t.Fatalf("Failed to remove cached.txt err: %v", err)
+	}
+
+	runDropBoxExamples(t, addr, client)
+	runMountExamples(t, addr)
+	runTenantExamples(t, addr, path.Join(wd, "/tmp/sftp-tenant"))
+	runPublicKeyExamples(t, addr, keySigner)
+	runCertificateExamples(t, addr, caSigner)
+	runMFAExamples(t, addr, totpSecret)
+
+	_, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "restricted",
+		Auth:            []ssh.AuthMethod{ssh.Password("partnerpassword")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("Expected sign in from outside the allowed CIDRs to fail")
+	}
+	local, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "local",
+		Auth:            []ssh.AuthMethod{ssh.Password("partnerpassword")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	})
+	if err != nil {
+		t.Fatalf("Expected sign in from an allowed CIDR to succeed ssh.Dial failed %v", err)
+	}
+	local.Close()
+	fmt.Println("File finished")
+}
 
+func TestE2EAuthWebhook(t *testing.T) {
+	wd, err := os.Getwd()
 	if err != nil {
-		t.Fatalf("Could not create minio session: %v", err)
+		t.Fatal("Failed to get working dir", err)
 	}
-	s3serv := s3.New(sess)
-	createBucketInput := &s3.CreateBucketInput{
-		Bucket: aws.String("test-bucket"),
+	tmpDir := path.Join(wd, "/tmp/sftp-webhook")
+	_ = os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		t.Fatal("Could not create sftp-webhook dir")
 	}
-	_, err = s3serv.CreateBucket(createBucketInput)
+	defer os.RemoveAll(tmpDir)
+
+	//the endpoint allows the key of hooked and denies any other key
+	hookedKey, err := newTestSigner()
 	if err != nil {
-		t.Fatal("Failed to create bucket ", err)
+		t.Fatal(err)
+	}
+	otherKey, err := newTestSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKey := func(signer ssh.Signer) string {
+		return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey())))
 	}
 
-	defer func() {
-		listObjectsInput := &s3.ListObjectsInput{
-			Bucket: aws.String("test-bucket"),
-		}
-
-		listObjectsOutput, err := s3serv.ListObjects(listObjectsInput)
-		for _, obj := range listObjectsOutput.Contents {
-			deleteObjectInput := &s3.DeleteObjectInput{
-				Bucket: aws.String("test-bucket"),
-				Key:    obj.Key,
-			}
-			_, err := s3serv.DeleteObject(deleteObjectInput)
-			if err != nil {
-				t.Fatal("Failed to delete object", err)
+	var requests int32
+	//failure makes the endpoint answer with a server error when it is 1, and too late when it is 2
+	var failure int32
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch atomic.LoadInt32(&failure) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case 2:
+			select {
+			case <-time.After(3 * time.Second):
+			case <-r.Context().Done():
 			}
+			return
 		}
-		deleteBucketInput := &s3.DeleteBucketInput{
-			Bucket: aws.String("test-bucket"),
+		var req struct {
+			Username  string `json:"username"`
+			Password  string `json:"password"`
+			PublicKey string `json:"public_key"`
 		}
-
-		_, err = s3serv.DeleteBucket(deleteBucketInput)
-		if err != nil {
-			t.Fatal("Failed to delete bucket", err)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-	}()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"allow":    req.Username == "hooked" && (req.Password == "identitypassword" || req.PublicKey == authorizedKey(hookedKey)),
+			"home_dir": "homes/hooked",
+		})
+	}))
+	defer identity.Close()
+
+	provider, err := writeTestConfig("tmp/test-webhook-config.json", config.ServerConfig{
+		StorageURL:  fmt.Sprintf("file://%v", tmpDir),
+		AuthWebhook: &config.AuthWebhookConfig{URL: identity.URL, TimeoutSeconds: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("tmp/test-webhook-config.json")
 
 	privateBytes, err := ioutil.ReadFile("testdata/id_rsa")
 	if err != nil {
 		t.Fatal("Failed to load private key", err)
 	}
-
 	private, err := ssh.ParsePrivateKey(privateBytes)
 	if err != nil {
 		t.Fatal("Failed to parse private key", err)
 	}
-
-	serverConfig := server.Config{
-		HostKey: private,
-		Port:    2022,
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) error {
-			if string(pass) != "securetestpassword" {
-				return errors.New("Unexpected password")
-			}
-			return nil
-		},
-		BucketCallback: func(c ssh.ConnMetadata) (*blob.Bucket, error) {
-			if err != nil {
-				return nil, err
-			}
-
-			bucket, err := s3blob.OpenBucket(context.Background(), sess, "test-bucket", nil)
-			if err != nil {
-				return nil, err
-			}
-
-			return bucket, nil
-		},
+	serverConfig, err := provider.ServerConfig(server.Config{
+		HostKey:  private,
+		BindAddr: "0.0.0.0",
+		Port:     2025,
+	})
+	if err != nil {
+		t.Fatal("Failed to load ServerConfig", err)
 	}
-
-	server, cond := startTestServer(&serverConfig)
+	server, cond := startTestServer(serverConfig)
 	defer server.Close()
-
-	//indicates that the server is ready for requests
 	cond.Wait()
 
-	password := "securetestpassword"
-	config := ssh.ClientConfig{
-		User:            "testuser",
-		Auth:            []ssh.AuthMethod{ssh.Password(password)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", 2025)
+	dial := func(password string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "hooked",
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
 	}
 
-	addr := fmt.Sprintf("%s:%d", "127.0.0.1", 2022)
-	conn, err := ssh.Dial("tcp", addr, &config)
-	if err != nil {
-		t.Fatalf("Could not create client ssh.Dial failed %v", err)
+	if _, err := dial("wrongpassword"); err == nil {
+		t.Fatal("Expected sign in denied by the webhook to fail")
+	}
+
+	//the endpoint failing refuses even correct credentials
+	atomic.StoreInt32(&failure, 1)
+	if _, err := dial("identitypassword"); err == nil {
+		t.Fatal("Expected sign in to fail while the webhook responds with a server error")
+	}
+	atomic.StoreInt32(&failure, 2)
+	if _, err := dial("identitypassword"); err == nil {
+		t.Fatal("Expected sign in to fail while the webhook times out")
 	}
+	atomic.StoreInt32(&failure, 0)
 
+	conn, err := dial("identitypassword")
+	if err != nil {
+		t.Fatalf("Could not sign in through the webhook ssh.Dial failed %v", err)
+	}
 	client, err := sftp.NewClient(conn)
 	if err != nil {
 		t.Fatalf("Creating sftp client failed with %v", err)
 	}
 	defer client.Close()
-	runSharedExamples(t, client)
-	fmt.Println("Minio finished")
-}
-
-func startTestServer(c *server.Config) (*server.Server, *sync.Cond) {
-	m := &sync.Mutex{}
-	m.Lock()
-	cond := sync.NewCond(m)
-
-	server := server.New(c)
-	go func() {
-		err := server.ListenAndServe(cond)
-		if err != nil {
-			log.Fatal("Failed to start server", err)
-		}
-	}()
 
-	return server, cond
-}
-
-func runSharedExamples(t *testing.T, client *sftp.Client) {
-	f, err := client.Create("hello.txt")
-	if err != nil {
-		t.Fatalf("Creating hello.txt failed with %v", err)
+	if _, err := writeStrToRemoteFile(client, "home.txt", "Home"); err != nil {
+		t.Fatalf("Failed to write home.txt err: %v", err)
 	}
-
-	if _, err := f.Write([]byte("Hello world!")); err != nil {
-		t.Fatalf("Writing data to hello.txt failed with %v", err)
+	contents, err := ioutil.ReadFile(path.Join(tmpDir, "homes/hooked/home.txt"))
+	if err != nil || string(contents) != "Home" {
+		t.Fatalf("Expected home.txt to be stored in the home dir err: %v", err)
 	}
 
-	f.Close()
-
-	stat, err := client.Lstat("hello.txt")
+	before := atomic.LoadInt32(&requests)
+	conn, err = dial("identitypassword")
 	if err != nil {
-		t.Fatal("Failed to stat hello.txt file")
+		t.Fatalf("Could not sign in through the webhook again ssh.Dial failed %v", err)
 	}
-	file, err := client.Open("hello.txt")
-	if err != nil {
-		t.Fatalf("Failed to open hello.txt %v", err)
+	conn.Close()
+	if atomic.LoadInt32(&requests) != before {
+		t.Fatal("Expected the second sign in to be answered from the cache")
 	}
 
-	b := make([]byte, stat.Size())
-	_, err = file.Read(b)
+	//a key sign in is rooted at the home the endpoint gave that key
+	conn, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "hooked",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(otherKey, hookedKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
 	if err != nil {
-		t.Fatalf("Failed to read file %v", err)
+		t.Fatalf("Could not sign in with a key through the webhook ssh.Dial failed %v", err)
 	}
-
-	if string(b) != "Hello world!" {
-		t.Fatalf("Expected file to eq 'Hello world!' not %v", string(b))
+	client, err = sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating sftp client failed with %v", err)
 	}
-
-	largeUUIDString := ""
-	for i := 1; i <= 10000; i++ {
-		largeUUIDString = largeUUIDString + uuid.New().String()
+	defer client.Close()
+	if _, err := readStrFromRemoteFile(client, "home.txt"); err != nil {
+		t.Fatalf("Expected the session to be rooted at the home of the key it signed with err: %v", err)
 	}
+}
 
-	_, err = writeStrToRemoteFile(client, "large_file.txt", largeUUIDString)
+func TestE2EBans(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("banpassword"), bcrypt.MinCost)
 	if err != nil {
-		t.Fatalf("Failed to write large_file.txt err: %v", err)
+		t.Fatal("Failed to hash password")
 	}
-
-	stat, err = client.Lstat("large_file.txt")
+	provider, err := writeTestConfig("tmp/test-bans-config.json", config.ServerConfig{
+		StorageURL: "mem://",
+		Users: []config.UserConfig{{
+			UserName:     "banned",
+			PasswordHash: string(passwordHash),
+		}},
+	})
 	if err != nil {
-		t.Fatal("Failed to stat large_file.txt file")
+		t.Fatal(err)
 	}
+	defer os.Remove("tmp/test-bans-config.json")
 
-	str, err := readStrFromRemoteFile(client, "large_file.txt")
+	privateBytes, err := ioutil.ReadFile("testdata/id_rsa")
 	if err != nil {
-		t.Fatalf("Failed to read large_file.txt err: %v", err)
+		t.Fatal("Failed to load private key", err)
 	}
-	if str != largeUUIDString {
-		t.Fatal("Expected contents from reading large_file.txt to equal largeUUIDString")
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		t.Fatal("Failed to parse private key", err)
 	}
-	if err = client.Remove("large_file.txt"); err != nil {
-		t.Fatalf("Failed to remove large_file.txt err: %v", err)
+	defaultConfig := server.Config{
+		HostKey:          private,
+		BindAddr:         "0.0.0.0",
+		Port:             2026,
+		MaxAuthFailures:  2,
+		AuthFailureDelay: -1,
 	}
-
-	err = client.Rename("hello.txt", "hello_miss_president.txt")
+	serverConfig, err := provider.ServerConfig(defaultConfig)
 	if err != nil {
-		t.Fatalf("Failed to rename file %v", err)
+		t.Fatal("Failed to load ServerConfig", err)
 	}
+	server, cond := startTestServer(serverConfig)
+	defer server.Close()
+	cond.Wait()
 
-	list, err := client.ReadDir("/")
-
-	if err != nil {
-		t.Fatalf("Listing root dir failed %v", err)
+	dial := func(password string) error {
+		conn, err := ssh.Dial("tcp", "127.0.0.1:2026", &ssh.ClientConfig{
+			User:            "banned",
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
 	}
 
-	found := false
-	for _, l := range list {
-		fmt.Println(l.Name())
-		if l.Name() == "hello_miss_president.txt" {
-			found = true
+	for i := 0; i < 2; i++ {
+		if err := dial("wrongpassword"); err == nil {
+			t.Fatal("Expected sign in with a wrong password to fail")
 		}
 	}
-
-	if found == false {
-		t.Fatalf("failed to find file after renaming %v", err)
+	if err := dial("banpassword"); err == nil {
+		t.Fatal("Expected sign in from a banned ip to fail")
+	}
+	if bans := server.Bans().List(); len(bans) != 2 {
+		t.Fatalf("Expected the ip and the username to be banned, got %v", bans)
 	}
 
-	if len(list) != 1 {
-		t.Fatal("Too many files for dir when listing")
+	server.Bans().Clear("", "")
+	if err := dial("banpassword"); err != nil {
+		t.Fatalf("Could not sign in once the bans were cleared ssh.Dial failed %v", err)
 	}
+}
 
-	err = client.Mkdir("my_dir")
+func writeTestConfig(name string, c config.ServerConfig) (config.Provider, error) {
+	d, err := json.Marshal(&c)
 	if err != nil {
-		t.Fatalf("Failed to create dir %v", err)
+		return nil, err
 	}
+	if err := ioutil.WriteFile(name, d, 0700); err != nil {
+		return nil, err
+	}
+	return config.ParseConfigSource(name)
+}
 
-	info, err := client.Stat("my_dir")
-	if err != nil {
-		t.Fatalf("Failed to stat dir %v", err)
+func TestE2EConfigValidate(t *testing.T) {
+	sources := map[string]string{
+		"yaml": `storage_url: mem://
+users:
+  - username: alice
+    password_hash: not-a-bcrypt-hash
+  - username: alice
+    pasword_hash: typo
+  - username: bob
+    storage_url: s3://archive
+    upload:
+      concurrency: 4
+`,
+		"toml": `storage_url = "mem://"
+
+[[users]]
+username = "alice"
+password_hash = "not-a-bcrypt-hash"
+
+[[users]]
+username = "alice"
+pasword_hash = "typo"
+
+[[users]]
+username = "bob"
+storage_url = "s3://archive"
+
+[users.upload]
+concurrency = 4
+`,
+	}
+	//the line of each problem in each format
+	lines := map[string][]int{
+		"yaml": {6, 4, 5, 10},
+		"toml": {9, 5, 8, 16},
 	}
+	for format, source := range sources {
+		name := "tmp/test-invalid-config." + format
+		if err := ioutil.WriteFile(name, []byte(source), 0700); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(name)
 
-	if info.Name() != "my_dir" {
-		t.Fatal("Expected dir name to equal my_dir")
+		provider, err := config.ParseConfigSource(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems, err := provider.Validate(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{
+			`users[1]: Unknown field "pasword_hash"`,
+			"users[0].password_hash: Malformed bcrypt hash: crypto/bcrypt: hashedSecret too short to be a bcrypted password",
+			"users[1].username: Duplicate username alice, it is also users[0]",
+			"users[2].upload.concurrency: Upload concurrency only applies to Azure, the S3 driver always uploads 5 parts in parallel",
+		}
+		if len(problems) != len(expected) {
+			t.Fatalf("Expected %v problems in the %v config, got %v", len(expected), format, problems)
+		}
+		if c, again, err := provider.ReadValidConfig(); c != nil || err != nil || !reflect.DeepEqual(again, problems) {
+			t.Fatalf("Expected the %v config to be refused with its problems, got %v %v", format, again, err)
+		}
+		for i, p := range problems {
+			if expected := fmt.Sprintf("line %v: %v", lines[format][i], expected[i]); p.String() != expected {
+				t.Fatalf("Expected %q in the %v config, got %q", expected, format, p.String())
+			}
+		}
 	}
+}
 
-	err = client.RemoveDirectory("my_dir")
+func TestE2EUserManagement(t *testing.T) {
+	provider, err := writeTestConfig("tmp/test-users-config.json", config.ServerConfig{
+		StorageURL: "mem://",
+		ACL: []config.ACLRule{
+			{Path: "/reports/**", Allow: []string{"read"}, Users: []string{"bob"}},
+			{Path: "/shared/**", Allow: []string{"write"}, Users: []string{"bob", "carol"}},
+			{Path: "/team/**", Allow: []string{"write"}, Users: []string{"bob"}, Groups: []string{"team"}},
+			{Path: "/**", Allow: []string{"list"}},
+		},
+	})
 	if err != nil {
-		t.Fatalf("Failed to remove dir %v", err)
+		t.Fatal(err)
 	}
+	defer os.Remove("tmp/test-users-config.json")
 
-	info, err = client.Stat("my_dir")
-	if err == nil {
-		fmt.Println(info.Name())
-		t.Fatal("Expected stat to error for deleted directory")
+	if err := provider.AddUser("bob", "bobpassword", []byte{}); err != nil {
+		t.Fatalf("Failed to add user %v", err)
+	}
+	if err := provider.AddUser("bob", "bobpassword", []byte{}); err == nil {
+		t.Fatal("Expected adding a user twice to fail")
+	}
+	if err := provider.SetPassword("bob", "newpassword"); err != nil {
+		t.Fatalf("Failed to set password %v", err)
+	}
+	if err := provider.SetDisabled("bob", true); err != nil {
+		t.Fatalf("Failed to disable user %v", err)
+	}
+	if err := provider.RenameUser("bob", "robert"); err != nil {
+		t.Fatalf("Failed to rename user %v", err)
 	}
 
-	err = client.Remove("hello_miss_president.txt")
+	c, err := provider.ReadConfig()
 	if err != nil {
-		t.Fatalf("Failed to remove file %v", err)
+		t.Fatal(err)
 	}
-
-	_, err = client.Stat("hello_miss_president.txt")
-	if err == nil {
-		t.Fatalf("Expected there to be an err when stating a deleted file")
+	u, err := provider.GetUser("robert")
+	if err != nil || !u.Disabled || c.Allows("robert") || c.ACL[0].Users[0] != "robert" {
+		t.Fatalf("Expected robert to be disabled and named by the acl err: %v", err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte("newpassword")) != nil {
+		t.Fatal("Expected the password to be changed")
 	}
-}
+
+	if err := provider.RemoveUser("robert"); err != nil {
+		t.Fatalf("Failed to remove user %v", err)
+	}
+	users, err := provider.ListUsers()
+	if err != nil || len(users) != 0 {
+		t.Fatalf("Expected no users, got %v err: %v", users, err)
+	}
+	if err := provider.RemoveUser("robert"); err == nil {
+		t.Fatal("Expected removing an unknown user to fail")
+	}
+
+	//a user added again under the name of a removed one gets none of their grants
+	c, err = provider.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []config.ACLRule{
+		{Path: "/shared/**", Allow: []string{"write"}, Users: []string{"carol"}},
+		{Path: "/team/**", Allow: []string{"write"}, Groups: []string{"team"}},
+		{Path: "/**", Allow: []string{"list"}},
+	}
+	if !reflect.DeepEqual(c.ACL, expected) {
+		t.Fatalf("Expected the rules of the removed user to be dropped, got %+v", c.ACL)
+	}
+}
+
+func TestE2EFailingBucket(t *testing.T) {
+	privateBytes, err := ioutil.ReadFile("testdata/id_rsa")
+	if err != nil {
+		t.Fatal("Failed to load private key", err)
+	}
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		t.Fatal("Failed to parse private key", err)
+	}
+
+	server, cond := startTestServer(&server.Config{
+		HostKey:  private,
+		BindAddr: "0.0.0.0",
+		Port:     2027,
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+		BucketCallback: func(conn ssh.ConnMetadata) (*blob.Bucket, error) {
+			return blob.NewBucket(&failingBucket{limit: 1 << 20}), nil
+		},
+	})
+	defer server.Close()
+	cond.Wait()
+
+	conn, err := ssh.Dial("tcp", "127.0.0.1:2027", &ssh.ClientConfig{
+		User:            "writer",
+		Auth:            []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Could not create client ssh.Dial failed %v", err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating sftp client failed with %v", err)
+	}
+	defer client.Close()
+
+	f, err := client.Create("full.txt")
+	if err != nil {
+		t.Fatalf("Creating full.txt failed with %v", err)
+	}
+	defer f.Close()
+
+	//the bucket fails after 1MB, the client learns it from a write rather than at Close
+	if _, err := f.Write(make([]byte, 8<<20)); !os.IsPermission(err) {
+		t.Fatalf("Expected the bucket's permission denied to reach the client, got %v", err)
+	}
+}
+
+//failingBucket is a bucket whose uploads fail with permission denied once they pass limit bytes
+type failingBucket struct {
+	driver.Bucket
+	limit int
+}
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+func (b *failingBucket) ErrorCode(err error) gcerrors.ErrorCode {
+	if err == errQuotaExceeded {
+		return gcerrors.PermissionDenied
+	}
+	return gcerrors.NotFound
+}
+
+func (b *failingBucket) As(i interface{}) bool {
+	return false
+}
+
+func (b *failingBucket) ErrorAs(err error, i interface{}) bool {
+	return false
+}
+
+func (b *failingBucket) Attributes(ctx context.Context, key string) (*driver.Attributes, error) {
+	return nil, os.ErrNotExist
+}
+
+func (b *failingBucket) NewTypedWriter(ctx context.Context, key, contentType string, opts *driver.WriterOptions) (driver.Writer, error) {
+	return &failingWriter{limit: b.limit}, nil
+}
+
+func (b *failingBucket) Close() error {
+	return nil
+}
+
+type failingWriter struct {
+	limit   int
+	written int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) > w.limit {
+		return 0, errQuotaExceeded
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func (w *failingWriter) Close() error {
+	return nil
+}
+
+func TestE2EAdmin(t *testing.T) {
+	privateBytes, err := ioutil.ReadFile("testdata/id_rsa")
+	if err != nil {
+		t.Fatal("Failed to load private key", err)
+	}
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		t.Fatal("Failed to parse private key", err)
+	}
+	server, cond := startTestServer(&server.Config{
+		HostKey:    private,
+		BindAddr:   "0.0.0.0",
+		Port:       2028,
+		AdminAddr:  "127.0.0.1:2029",
+		AdminToken: "admintoken",
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("denied")
+		},
+	})
+	defer server.Close()
+	cond.Wait()
+
+	clearBans := func(token string) int {
+		req, err := http.NewRequest(http.MethodDelete, "http://127.0.0.1:2029/bans", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) != 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		//the admin server starts alongside the listener
+		for i := 0; ; i++ {
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				if i == 50 {
+					t.Fatalf("Admin server not reachable %v", err)
+				}
+				time.Sleep(20 * time.Millisecond)
+				continue
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+	}
+	if status := clearBans(""); status != http.StatusUnauthorized {
+		t.Fatalf("Expected clearing bans without the admin token to be refused, got %v", status)
+	}
+	if status := clearBans("wrongtoken"); status != http.StatusUnauthorized {
+		t.Fatalf("Expected clearing bans with a wrong admin token to be refused, got %v", status)
+	}
+	if status := clearBans("admintoken"); status != http.StatusOK {
+		t.Fatalf("Expected clearing bans with the admin token to succeed, got %v", status)
+	}
+}
+
+func TestE2ESourceFilter(t *testing.T) {
+	privateBytes, err := ioutil.ReadFile("testdata/id_rsa")
+	if err != nil {
+		t.Fatal("Failed to load private key", err)
+	}
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		t.Fatal("Failed to parse private key", err)
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:            "filtered",
+		Auth:            []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	for i, filter := range []struct {
+		allowed []string
+		denied  []string
+		accepts bool
+	}{
+		{allowed: []string{"127.0.0.0/8"}, accepts: true},
+		{allowed: []string{"203.0.113.0/24"}, accepts: false},
+		{allowed: []string{"127.0.0.0/8"}, denied: []string{"127.0.0.1/32"}, accepts: false},
+		{denied: []string{"203.0.113.0/24"}, accepts: true},
+	} {
+		port := 2030 + i
+		server, cond := startTestServer(&server.Config{
+			HostKey:      private,
+			BindAddr:     "127.0.0.1",
+			Port:         port,
+			AllowedCIDRs: filter.allowed,
+			DeniedCIDRs:  filter.denied,
+			PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+				return nil, nil
+			},
+		})
+		cond.Wait()
+
+		conn, err := ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port), clientConfig)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != filter.accepts {
+			t.Fatalf("Expected allowing %v and denying %v to accept 127.0.0.1: %v, got %v", filter.allowed, filter.denied, filter.accepts, err)
+		}
+		server.Close()
+	}
+}
+
+func TestE2ELimits(t *testing.T) {
+	server := startOpenServer(t, &server.Config{
+		Port:                  2034,
+		MaxConnections:        2,
+		MaxConnectionsPerUser: 1,
+		MaxPendingConnections: 2,
+		HandshakeTimeout:      500 * time.Millisecond,
+	})
+	defer server.Close()
+
+	dial := func(user string) *ssh.Client {
+		return dialOpenServer(t, "127.0.0.1:2034", user)
+	}
+
+	//a connection that never signs in doesn't take the place of an authenticated one
+	idle, err := net.Dial("tcp", "127.0.0.1:2034")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	first := dial("alice")
+	defer first.Close()
+	if _, err := sftp.NewClient(first); err != nil {
+		t.Fatalf("Creating sftp client failed with %v", err)
+	}
+
+	second := dial("alice")
+	if _, err := sftp.NewClient(second); err == nil {
+		t.Fatal("Expected a session beyond the connections allowed per user to fail")
+	}
+	second.Close()
+
+	other := dial("bob")
+	defer other.Close()
+	if _, err := sftp.NewClient(other); err != nil {
+		t.Fatalf("Creating sftp client failed with %v", err)
+	}
+	third := dial("carol")
+	_, err = sftp.NewClient(third)
+	if err == nil || !strings.Contains(err.Error(), "as many connections as it may") {
+		t.Fatalf("Expected a session beyond the connections allowed in total to fail with a message, got %v", err)
+	}
+	third.Close()
+
+	//the handshake timeout closes the connection that never signs in
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := ioutil.ReadAll(idle); err != nil {
+		t.Fatalf("Expected the server to close a connection that doesn't sign in, got %v", err)
+	}
+
+	//with both places for connections signing in taken, the next one is told to wait
+	for i := 0; i < 2; i++ {
+		pending, err := net.Dial("tcp", "127.0.0.1:2034")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pending.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+	refused, err := net.Dial("tcp", "127.0.0.1:2034")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.SetReadDeadline(time.Now().Add(time.Second))
+	message, err := ioutil.ReadAll(refused)
+	if err != nil || !strings.Contains(string(message), "Too many connections are signing in") {
+		t.Fatalf("Expected a connection beyond the pending ones allowed to be refused with a message, got %q %v", message, err)
+	}
+}
+
+//startOpenServer starts a server serving c on 127.0.0.1 from a memory bucket, which lets every
+//password sign in
+func startOpenServer(t *testing.T, c *server.Config) *server.Server {
+	privateBytes, err := ioutil.ReadFile("testdata/id_rsa")
+	if err != nil {
+		t.Fatal("Failed to load private key", err)
+	}
+	c.HostKey, err = ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		t.Fatal("Failed to parse private key", err)
+	}
+	c.BindAddr = "127.0.0.1"
+	c.StorageURL = "mem://"
+	c.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		return nil, nil
+	}
+	server, cond := startTestServer(c)
+	cond.Wait()
+	return server
+}
+
+//dialOpenServer signs in to a server of startOpenServer at addr
+func dialOpenServer(t *testing.T, addr string, user string) *ssh.Client {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Could not sign in as %v ssh.Dial failed %v", user, err)
+	}
+	return conn
+}
+
+func TestE2EIdleTimeout(t *testing.T) {
+	server := startOpenServer(t, &server.Config{
+		Port:        2035,
+		IdleTimeout: time.Second,
+		//keepalives don't count as activity
+		KeepaliveInterval: 100 * time.Millisecond,
+	})
+	defer server.Close()
+
+	conn := dialOpenServer(t, "127.0.0.1:2035", "idle")
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating sftp client failed with %v", err)
+	}
+	defer client.Close()
+
+	//activity keeps the session open past the timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(500 * time.Millisecond)
+		if _, err := client.ReadDir("/"); err != nil {
+			t.Fatalf("Expected the active session to stay open, got %v", err)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := client.ReadDir("/"); err == nil {
+		t.Fatal("Expected the idle session to be closed")
+	}
+}
+
+func TestE2EMaxSessionDuration(t *testing.T) {
+	server := startOpenServer(t, &server.Config{
+		Port:               2036,
+		MaxSessionDuration: 500 * time.Millisecond,
+	})
+	defer server.Close()
+
+	conn := dialOpenServer(t, "127.0.0.1:2036", "busy")
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating sftp client failed with %v", err)
+	}
+	defer client.Close()
+
+	//a session that keeps working is still closed when its time is up
+	started := time.Now()
+	for time.Since(started) < 2*time.Second {
+		if _, err := client.ReadDir("/"); err != nil {
+			if time.Since(started) < 500*time.Millisecond {
+				t.Fatalf("Expected the session to be closed after 500ms, not %v", time.Since(started))
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("Expected the session to be closed once the maximum session duration was reached")
+}
+
+func TestE2EKeepalive(t *testing.T) {
+	server := startOpenServer(t, &server.Config{
+		Port:              2037,
+		KeepaliveInterval: 100 * time.Millisecond,
+		KeepaliveCountMax: 2,
+	})
+	defer server.Close()
+
+	//the client goes through a proxy that can stop forwarding, as a dead peer does, without closing
+	//the connection
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	var frozen int32
+	closedByServer := make(chan struct{})
+	go func() {
+		client, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		upstream, err := net.Dial("tcp", "127.0.0.1:2037")
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		forward := func(dst net.Conn, src net.Conn) {
+			buf := make([]byte, 32<<10)
+			for {
+				n, err := src.Read(buf)
+				if err != nil {
+					return
+				}
+				if atomic.LoadInt32(&frozen) == 0 {
+					dst.Write(buf[:n])
+				}
+			}
+		}
+		go forward(upstream, client)
+		forward(client, upstream)
+		close(closedByServer)
+	}()
+
+	conn := dialOpenServer(t, proxy.Addr().String(), "alive")
+	defer conn.Close()
+
+	//a client answering keepalives stays connected without any activity
+	select {
+	case <-closedByServer:
+		t.Fatal("Expected a client answering keepalives to stay connected")
+	case <-time.After(600 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&frozen, 1)
+	select {
+	case <-closedByServer:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a client that stopped answering keepalives to be disconnected")
+	}
+}
+
+func TestE2EMinio(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("minio", "miniosecret", ""),
+		Region:           aws.String("us-west-1"),
+		Endpoint:         aws.String("localhost:9000"),
+		DisableSSL:       aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+
+	if err != nil {
+		t.Fatalf("Could not create minio session: %v", err)
+	}
+	s3serv := s3.New(sess)
+	createBucketInput := &s3.CreateBucketInput{
+		Bucket: aws.String("test-bucket"),
+	}
+	_, err = s3serv.CreateBucket(createBucketInput)
+	if err != nil {
+		t.Fatal("Failed to create bucket ", err)
+	}
+
+	defer func() {
+		listObjectsInput := &s3.ListObjectsInput{
+			Bucket: aws.String("test-bucket"),
+		}
+
+		listObjectsOutput, err := s3serv.ListObjects(listObjectsInput)
+		for _, obj := range listObjectsOutput.Contents {
+			deleteObjectInput := &s3.DeleteObjectInput{
+				Bucket: aws.String("test-bucket"),
+				Key:    obj.Key,
+			}
+			_, err := s3serv.DeleteObject(deleteObjectInput)
+			if err != nil {
+				t.Fatal("Failed to delete object", err)
+			}
+		}
+		deleteBucketInput := &s3.DeleteBucketInput{
+			Bucket: aws.String("test-bucket"),
+		}
+
+		_, err = s3serv.DeleteBucket(deleteBucketInput)
+		if err != nil {
+			t.Fatal("Failed to delete bucket", err)
+		}
+	}()
+
+	privateBytes, err := ioutil.ReadFile("testdata/id_rsa")
+	if err != nil {
+		t.Fatal("Failed to load private key", err)
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		t.Fatal("Failed to parse private key", err)
+	}
+
+	serverConfig := server.Config{
+		HostKey: private,
+		Port:    2022,
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) != "securetestpassword" {
+				return nil, errors.New("Unexpected password")
+			}
+			return nil, nil
+		},
+		BucketCallback: func(c ssh.ConnMetadata) (*blob.Bucket, error) {
+			if err != nil {
+				return nil, err
+			}
+
+			bucket, err := s3blob.OpenBucket(context.Background(), sess, "test-bucket", nil)
+			if err != nil {
+				return nil, err
+			}
+
+			return bucket, nil
+		},
+	}
+
+	server, cond := startTestServer(&serverConfig)
+	defer server.Close()
+
+	//indicates that the server is ready for requests
+	cond.Wait()
+
+	password := "securetestpassword"
+	config := ssh.ClientConfig{
+		User:            "testuser",
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", 2022)
+	conn, err := ssh.Dial("tcp", addr, &config)
+	if err != nil {
+		t.Fatalf("Could not create client ssh.Dial failed %v", err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating sftp client failed with %v", err)
+	}
+	defer client.Close()
+	runSharedExamples(t, client)
+	fmt.Println("Minio finished")
+}
+
+func startTestServer(c *server.Config) (*server.Server, *sync.Cond) {
+	m := &sync.Mutex{}
+	m.Lock()
+	cond := sync.NewCond(m)
+
+	server := server.New(c)
+	go func() {
+		err := server.ListenAndServe(cond)
+		if err != nil {
+			log.Fatal("Failed to start server", err)
+		}
+	}()
+
+	return server, cond
+}
+
+func runSharedExamples(t *testing.T, client *sftp.Client) {
+	f, err := client.Create("hello.txt")
+	if err != nil {
+		t.Fatalf("Creating hello.txt failed with %v", err)
+	}
+
+	if _, err := f.Write([]byte("Hello world!")); err != nil {
+		t.Fatalf("Writing data to hello.txt failed with %v", err)
+	}
+
+	f.Close()
+
+	stat, err := client.Lstat("hello.txt")
+	if err != nil {
+		t.Fatal("Failed to stat hello.txt file")
+	}
+	file, err := client.Open("hello.txt")
+	if err != nil {
+		t.Fatalf("Failed to open hello.txt %v", err)
+	}
+
+	b := make([]byte, stat.Size())
+	_, err = file.Read(b)
+	if err != nil {
+		t.Fatalf("Failed to read file %v", err)
+	}
+
+	if string(b) != "Hello world!" {
+		t.Fatalf("Expected file to eq 'Hello world!' not %v", string(b))
+	}
+
+	err = client.Truncate("hello.txt", 5)
+	if err != nil {
+		t.Fatalf("Failed to shrink hello.txt %v", err)
+	}
+
+	str, err := readStrFromRemoteFile(client, "hello.txt")
+	if err != nil {
+		t.Fatalf("Failed to read hello.txt after shrinking %v", err)
+	}
+	if str != "Hello" {
+		t.Fatalf("Expected shrunk file to eq 'Hello' not %v", str)
+	}
+
+	err = client.Truncate("hello.txt", 7)
+	if err != nil {
+		t.Fatalf("Failed to grow hello.txt %v", err)
+	}
+
+	str, err = readStrFromRemoteFile(client, "hello.txt")
+	if err != nil {
+		t.Fatalf("Failed to read hello.txt after growing %v", err)
+	}
+	if str != "Hello\x00\x00" {
+		t.Fatalf("Expected grown file to be zero padded not %q", str)
+	}
+
+	_, err = writeStrToRemoteFile(client, "patch.txt", "Hello world!")
+	if err != nil {
+		t.Fatalf("Failed to write patch.txt err: %v", err)
+	}
+
+	rw, err := client.OpenFile("patch.txt", os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Failed to open patch.txt for reading and writing %v", err)
+	}
+
+	if _, err := rw.WriteAt([]byte("HELLO"), 0); err != nil {
+		t.Fatalf("Failed to patch patch.txt %v", err)
+	}
+
+	b = make([]byte, 12)
+	if _, err := rw.ReadAt(b, 0); err != nil && err != io.EOF {
+		t.Fatalf("Failed to read back patch.txt %v", err)
+	}
+	if string(b) != "HELLO world!" {
+		t.Fatalf("Expected patched handle to read 'HELLO world!' not %v", string(b))
+	}
+
+	if err := rw.Close(); err != nil {
+		t.Fatalf("Failed to close patch.txt %v", err)
+	}
+
+	str, err = readStrFromRemoteFile(client, "patch.txt")
+	if err != nil {
+		t.Fatalf("Failed to read patch.txt err: %v", err)
+	}
+	if str != "HELLO world!" {
+		t.Fatalf("Expected patch.txt to eq 'HELLO world!' not %v", str)
+	}
+
+	if err = client.Remove("patch.txt"); err != nil {
+		t.Fatalf("Failed to remove patch.txt err: %v", err)
+	}
+
+	//the chunks are written last to first, so the first is held in memory and the rest spill to disk
+	reversed, err := client.OpenFile("reversed.txt", os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		t.Fatalf("Failed to open reversed.txt for writing %v", err)
+	}
+	reversedContents := "0123456789abcdefghij"
+	for off := len(reversedContents) - 5; off >= 0; off -= 5 {
+		if _, err := reversed.WriteAt([]byte(reversedContents[off:off+5]), int64(off)); err != nil {
+			t.Fatalf("Failed to write reversed.txt at %v %v", off, err)
+		}
+	}
+	if err := reversed.Close(); err != nil {
+		t.Fatalf("Failed to close reversed.txt %v", err)
+	}
+
+	str, err = readStrFromRemoteFile(client, "reversed.txt")
+	if err != nil {
+		t.Fatalf("Failed to read reversed.txt err: %v", err)
+	}
+	if str != reversedContents {
+		t.Fatalf("Expected reversed.txt to eq %v not %v", reversedContents, str)
+	}
+
+	if err = client.Remove("reversed.txt"); err != nil {
+		t.Fatalf("Failed to remove reversed.txt err: %v", err)
+	}
+
+	largeUUIDString := ""
+	for i := 1; i <= 10000; i++ {
+		largeUUIDString = largeUUIDString + uuid.New().String()
+	}
+
+	_, err = writeStrToRemoteFile(client, "large_file.txt", largeUUIDString)
+	if err != nil {
+		t.Fatalf("Failed to write large_file.txt err: %v", err)
+	}
+
+	stat, err = client.Lstat("large_file.txt")
+	if err != nil {
+		t.Fatal("Failed to stat large_file.txt file")
+	}
+
+	str, err = readStrFromRemoteFile(client, "large_file.txt")
+	if err != nil {
+		t.Fatalf("Failed to read large_file.txt err: %v", err)
+	}
+	if str != largeUUIDString {
+		t.Fatal("Expected contents from reading large_file.txt to equal largeUUIDString")
+	}
+	if err = client.Remove("large_file.txt"); err != nil {
+		t.Fatalf("Failed to remove large_file.txt err: %v", err)
+	}
+
+	err = client.Rename("hello.txt", "hello_miss_president.txt")
+	if err != nil {
+		t.Fatalf("Failed to rename file %v", err)
+	}
+
+	list, err := client.ReadDir("/")
+
+	if err != nil {
+		t.Fatalf("Listing root dir failed %v", err)
+	}
+
+	found := false
+	for _, l := range list {
+		fmt.Println(l.Name())
+		if l.Name() == "hello_miss_president.txt" {
+			found = true
+		}
+	}
+
+	if found == false {
+		t.Fatalf("failed to find file after renaming %v", err)
+	}
+
+	if len(list) != 1 {
+		t.Fatal("Too many files for dir when listing")
+	}
+
+	err = client.Mkdir("my_dir")
+	if err != nil {
+		t.Fatalf("Failed to create dir %v", err)
+	}
+
+	info, err := client.Stat("my_dir")
+	if err != nil {
+		t.Fatalf("Failed to stat dir %v", err)
+	}
+
+	if info.Name() != "my_dir" {
+		t.Fatal("Expected dir name to equal my_dir")
+	}
+
+	err = client.RemoveDirectory("my_dir")
+	if err != nil {
+		t.Fatalf("Failed to remove dir %v", err)
+	}
+
+	info, err = client.Stat("my_dir")
+	if err == nil {
+		fmt.Println(info.Name())
+		t.Fatal("Expected stat to error for deleted directory")
+	}
+
+	err = client.Remove("hello_miss_president.txt")
+	if err != nil {
+		t.Fatalf("Failed to remove file %v", err)
+	}
+
+	_, err = client.Stat("hello_miss_president.txt")
+	if err == nil {
+		t.Fatalf("Expected there to be an err when stating a deleted file")
+	}
+}
+
+//runDropBoxExamples checks that a user that may only write can upload new files, but can't see or
+//replace anything
+func runDropBoxExamples(t *testing.T, addr string, client *sftp.Client) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "dropbox",
+		Auth:            []ssh.AuthMethod{ssh.Password("partnerpassword")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Could not create dropbox ssh.Dial failed %v", err)
+	}
+	dropBox, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating dropbox sftp client failed with %v", err)
+	}
+	defer dropBox.Close()
+
+	_, err = writeStrToRemoteFile(dropBox, "dropped.txt", "Dropped")
+	if err != nil {
+		t.Fatalf("Failed to write dropped.txt as dropbox err: %v", err)
+	}
+
+	str, err := readStrFromRemoteFile(client, "dropped.txt")
+	if err != nil || str != "Dropped" {
+		t.Fatalf("Expected dropped.txt to eq 'Dropped' not %q err: %v", str, err)
+	}
+
+	_, err = writeStrToRemoteFile(dropBox, "dropped.txt", "Replaced")
+	if !os.IsPermission(err) {
+		t.Fatalf("Expected overwriting dropped.txt as dropbox to be denied not %v", err)
+	}
+
+	_, err = readStrFromRemoteFile(dropBox, "dropped.txt")
+	if !os.IsPermission(err) {
+		t.Fatalf("Expected reading dropped.txt as dropbox to be denied not %v", err)
+	}
+
+	//a file that may not be stated fails like a missing one, so its name doesn't leak
+	_, err = dropBox.Stat("dropped.txt")
+	_, missingErr := dropBox.Stat("missing.txt")
+	if err == nil || missingErr == nil || err.Error() != missingErr.Error() {
+		t.Fatalf("Expected stating dropped.txt as dropbox to fail like a missing file not %v, %v", err, missingErr)
+	}
+
+	_, err = dropBox.ReadDir("/")
+	if !os.IsPermission(err) {
+		t.Fatalf("Expected listing as dropbox to be denied not %v", err)
+	}
+
+	err = dropBox.Remove("dropped.txt")
+	if !os.IsPermission(err) {
+		t.Fatalf("Expected removing dropped.txt as dropbox to be denied not %v", err)
+	}
+
+	if err = client.Remove("dropped.txt"); err != nil {
+		t.Fatalf("Failed to remove dropped.txt err: %v", err)
+	}
+
+	//an ACL rule lets the partners group read what is shared with them
+	if err = client.Mkdir("outgoing"); err != nil {
+		t.Fatalf("Failed to mkdir outgoing err: %v", err)
+	}
+	_, err = writeStrToRemoteFile(client, "outgoing/report.txt", "Report")
+	if err != nil {
+		t.Fatalf("Failed to write outgoing/report.txt err: %v", err)
+	}
+
+	files, err := dropBox.ReadDir("/outgoing")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected dropbox to list outgoing err: %v", err)
+	}
+
+	str, err = readStrFromRemoteFile(dropBox, "outgoing/report.txt")
+	if err != nil || str != "Report" {
+		t.Fatalf("Expected outgoing/report.txt to eq 'Report' not %q err: %v", str, err)
+	}
+
+	err = dropBox.Remove("outgoing/report.txt")
+	if !os.IsPermission(err) {
+		t.Fatalf("Expected removing outgoing/report.txt as dropbox to be denied not %v", err)
+	}
+
+	if err = client.RemoveDirectory("outgoing"); err == nil {
+		t.Fatal("Expected removing outgoing while it holds report.txt to fail")
+	}
+	if err = client.Remove("outgoing/report.txt"); err != nil {
+		t.Fatalf("Failed to remove outgoing/report.txt err: %v", err)
+	}
+	if err = client.RemoveDirectory("outgoing"); err != nil {
+		t.Fatalf("Failed to remove outgoing err: %v", err)
+	}
+}
+
+//runMountExamples checks a user whose file system is made of two mounted buckets
+func runMountExamples(t *testing.T, addr string) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "mounted",
+		Auth:            []ssh.AuthMethod{ssh.Password("partnerpassword")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Could not create mounted ssh.Dial failed %v", err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating mounted sftp client failed with %v", err)
+	}
+	defer client.Close()
+
+	files, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatalf("Failed to list / err: %v", err)
+	}
+	if len(files) != 2 || files[0].Name() != "archive" || !files[0].IsDir() || files[1].Name() != "inbox" {
+		t.Fatalf("Expected / to list the archive and inbox mounts not %v", files)
+	}
+
+	_, err = writeStrToRemoteFile(client, "/inbox/mounted.txt", "Mounted")
+	if err != nil {
+		t.Fatalf("Failed to write /inbox/mounted.txt err: %v", err)
+	}
+
+	if err = client.Rename("/inbox/mounted.txt", "/archive/mounted.txt"); err != nil {
+		t.Fatalf("Failed to rename across mounts err: %v", err)
+	}
+
+	str, err := readStrFromRemoteFile(client, "/archive/mounted.txt")
+	if err != nil || str != "Mounted" {
+		t.Fatalf("Expected /archive/mounted.txt to eq 'Mounted' not %q err: %v", str, err)
+	}
+
+	if _, err = client.Stat("/inbox/mounted.txt"); err == nil {
+		t.Fatal("Expected /inbox/mounted.txt to be gone after the rename")
+	}
+
+	if _, err = writeStrToRemoteFile(client, "/unmounted.txt", "Nowhere"); err == nil {
+		t.Fatal("Expected writing outside of the mounts to fail")
+	}
+
+	if err = client.Remove("/archive/mounted.txt"); err != nil {
+		t.Fatalf("Failed to remove /archive/mounted.txt err: %v", err)
+	}
+}
+
+//runTenantExamples checks that a user with a templated storage url is served from their own bucket
+func runTenantExamples(t *testing.T, addr string, tenantDir string) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "tenant",
+		Auth:            []ssh.AuthMethod{ssh.Password("partnerpassword")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Could not create tenant ssh.Dial failed %v", err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating tenant sftp client failed with %v", err)
+	}
+	defer client.Close()
+
+	_, err = writeStrToRemoteFile(client, "tenant.txt", "Tenant")
+	if err != nil {
+		t.Fatalf("Failed to write tenant.txt err: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(tenantDir, "tenant.txt"))
+	if err != nil || string(contents) != "Tenant" {
+		t.Fatalf("Expected tenant.txt to be stored in %v err: %v", tenantDir, err)
+	}
+
+	if err = client.Remove("tenant.txt"); err != nil {
+		t.Fatalf("Failed to remove tenant.txt err: %v", err)
+	}
+}
+
+func newTestSigner() (ssh.Signer, error) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+//runPublicKeyExamples checks that a user signs in with a key from the config, and not with another key
+func runPublicKeyExamples(t *testing.T, addr string, signer ssh.Signer) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "keyuser",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Could not sign in with public key ssh.Dial failed %v", err)
+	}
+	conn.Close()
+
+	other, err := newTestSigner()
+	if err != nil {
+		t.Fatalf("Failed to generate key %v", err)
+	}
+	conn, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "keyuser",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(other)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		conn.Close()
+		t.Fatal("Expected sign in with an unknown public key to fail")
+	}
+}
+
+//runCertificateExamples checks that certificates of the user CA sign in the users named in their principals
+func runCertificateExamples(t *testing.T, addr string, ca ssh.Signer) {
+	dial := func(principal string, serial uint64) error {
+		signer, err := newTestSigner()
+		if err != nil {
+			return err
+		}
+		cert := &ssh.Certificate{
+			Key:             signer.PublicKey(),
+			Serial:          serial,
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{principal},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(crand.Reader, ca); err != nil {
+			return err
+		}
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return err
+		}
+		conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "certuser",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	if err := dial("certuser", 1); err != nil {
+		t.Fatalf("Could not sign in with certificate ssh.Dial failed %v", err)
+	}
+	if err := dial("someoneelse", 1); err == nil {
+		t.Fatal("Expected sign in with a certificate for another principal to fail")
+	}
+	if err := dial("certuser", 13); err == nil {
+		t.Fatal("Expected sign in with a revoked certificate to fail")
+	}
+}
+
+//runMFAExamples checks that a user with mfa enabled needs their password and a fresh totp code
+func runMFAExamples(t *testing.T, addr string, secret string) {
+	code, err := config.TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate totp code %v", err)
+	}
+	dial := func(auth ...ssh.AuthMethod) error {
+		conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "mfauser",
+			Auth:            auth,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	answer := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{code}, nil
+	})
+
+	if err := dial(ssh.Password("partnerpassword")); err == nil {
+		t.Fatal("Expected sign in without a totp code to fail")
+	}
+	if err := dial(ssh.Password("partnerpassword"), answer); err != nil {
+		t.Fatalf("Could not sign in with password and totp code ssh.Dial failed %v", err)
+	}
+	if err := dial(ssh.Password("partnerpassword"), answer); err == nil {
+		t.Fatal("Expected sign in with a replayed totp code to fail")
+	}
+}
 
 func writeStrToRemoteFile(client *sftp.Client, remoteFileName string, contents string) (int64, error) {
 	f, err := client.Create(remoteFileName)
-	defer f.Close()
 	if err != nil {
 		return 0, err
 	}
+	defer f.Close()
 
 	return io.Copy(f, bytes.NewBufferString(contents))
 }
 
 func readStrFromRemoteFile(client *sftp.Client, remoteFileName string) (string, error) {
 	f, err := client.Open(remoteFileName)
-	defer f.Close()
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
 	fstat, err := f.Stat()
 	if err != nil {
 		return "", err
@@ -387,3 +1710,506 @@ func readStrFromRemoteFile(client *sftp.Client, remoteFileName string) (string,
 
 	return string(buf), nil
 }
+
+//BenchmarkE2EUpload uploads a large file with different upload tunings. It uses the local file
+//system unless CLOUD_SFTP_BENCH_STORAGE_URL points it at a real bucket, where the part size and
+//concurrency take effect.
+func BenchmarkE2EUpload(b *testing.B) {
+	wd, err := os.Getwd()
+	if err != nil {
+		b.Fatal("Failed to get working dir", err)
+	}
+
+	storageURL := os.Getenv("CLOUD_SFTP_BENCH_STORAGE_URL")
+	if len(storageURL) == 0 {
+		tmpDir := path.Join(wd, "/tmp/sftp-bench")
+		_ = os.RemoveAll(tmpDir)
+		if err := os.MkdirAll(tmpDir, 0700); err != nil {
+			b.Fatal("Could not create sftp-bench dir")
+		}
+		defer os.RemoveAll(tmpDir)
+		storageURL = fmt.Sprintf("file://%v", tmpDir)
+	}
+
+	privateBytes, err := ioutil.ReadFile("testdata/id_rsa")
+	if err != nil {
+		b.Fatal("Failed to load private key", err)
+	}
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		b.Fatal("Failed to parse private key", err)
+	}
+
+	var upload cloudfs.UploadOptions
+	server, cond := startTestServer(&server.Config{
+		HostKey:    private,
+		BindAddr:   "0.0.0.0",
+		Port:       2023,
+		StorageURL: storageURL,
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+		UploadOptionsCallback: func(c ssh.ConnMetadata) cloudfs.UploadOptions {
+			return upload
+		},
+	})
+	defer server.Close()
+	cond.Wait()
+
+	contents := make([]byte, 64<<20)
+	if _, err := rand.Read(contents); err != nil {
+		b.Fatal("Failed to generate contents", err)
+	}
+
+	benchmarks := []struct {
+		name   string
+		upload cloudfs.UploadOptions
+	}{
+		{"defaults", cloudfs.UploadOptions{}},
+		{"buffer-1MiB", cloudfs.UploadOptions{BufferSize: 1 << 20}},
+		{"part-16MiB", cloudfs.UploadOptions{PartSize: 16 << 20}},
+		{"part-16MiB-concurrency-8", cloudfs.UploadOptions{BufferSize: 1 << 20, PartSize: 16 << 20, Concurrency: 8}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			//the upload options are read when the session starts
+			upload = bm.upload
+			conn, err := ssh.Dial("tcp", "127.0.0.1:2023", &ssh.ClientConfig{
+				User:            "benchuser",
+				Auth:            []ssh.AuthMethod{ssh.Password("benchpassword")},
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			})
+			if err != nil {
+				b.Fatalf("Could not create client ssh.Dial failed %v", err)
+			}
+			client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+			if err != nil {
+				b.Fatalf("Creating sftp client failed with %v", err)
+			}
+			defer client.Close()
+
+			b.SetBytes(int64(len(contents)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f, err := client.Create("bench.bin")
+				if err != nil {
+					b.Fatalf("Failed to create bench.bin %v", err)
+				}
+				if _, err := f.ReadFrom(bytes.NewReader(contents)); err != nil {
+					b.Fatalf("Failed to upload bench.bin %v", err)
+				}
+				if err := f.Close(); err != nil {
+					b.Fatalf("Failed to close bench.bin %v", err)
+				}
+			}
+			b.StopTimer()
+			client.Remove("bench.bin")
+		})
+	}
+}
+
+func TestE2EShutdown(t *testing.T) {
+	draining := startOpenServer(t, &server.Config{Port: 2038})
+	defer draining.Close()
+
+	idle := dialOpenServer(t, "127.0.0.1:2038", "idle")
+	defer idle.Close()
+	uploading := dialOpenServer(t, "127.0.0.1:2038", "uploading")
+	defer uploading.Close()
+	f := createUpload(t, uploading)
+
+	type result struct {
+		summary server.ShutdownSummary
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		summary, err := draining.Shutdown(ctx)
+		done <- result{summary, err}
+	}()
+
+	//the idle connection is closed right away, the upload gets the grace period
+	closed := make(chan struct{})
+	go func() {
+		idle.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the idle connection to be closed when shutting down")
+	}
+	select {
+	case r := <-done:
+		t.Fatalf("Expected shutdown to wait for the upload, got %+v %v", r.summary, r.err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if _, err := f.Write([]byte("the rest")); err != nil {
+		t.Fatalf("Expected the upload to continue while shutting down %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Expected the upload to finish while shutting down %v", err)
+	}
+	select {
+	case r := <-done:
+		if r.err != nil || r.summary.Drained != 2 || r.summary.Cancelled != 0 {
+			t.Fatalf("Expected both connections to be drained, got %+v %v", r.summary, r.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected shutdown to end with the upload")
+	}
+
+	cancelling := startOpenServer(t, &server.Config{Port: 2039})
+	defer cancelling.Close()
+	stuck := dialOpenServer(t, "127.0.0.1:2039", "stuck")
+	defer stuck.Close()
+	createUpload(t, stuck)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	summary, err := cancelling.Shutdown(ctx)
+	if err == nil || summary.Cancelled != 1 {
+		t.Fatalf("Expected the upload to be cancelled at the end of the grace period, got %+v %v", summary, err)
+	}
+}
+
+//createUpload opens a file for writing over conn and leaves it open
+func createUpload(t *testing.T, conn *ssh.Client) *sftp.File {
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating sftp client failed with %v", err)
+	}
+	f, err := client.Create("upload.txt")
+	if err != nil {
+		t.Fatalf("Failed to create file %v", err)
+	}
+	if _, err := f.Write([]byte("some data")); err != nil {
+		t.Fatalf("Failed to write file %v", err)
+	}
+	return f
+}
+
+func TestE2EReload(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("reloadpassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal("Failed to hash password")
+	}
+	totpSecret := "JBSWY3DPEHPK3PXP"
+	user := func(name string) config.UserConfig {
+		return config.UserConfig{UserName: name, PasswordHash: string(passwordHash)}
+	}
+	mfa := user("mfa")
+	mfa.TOTPSecret = totpSecret
+	source := "tmp/test-reload-config.json"
+	write := func(c config.ServerConfig) {
+		if _, err := writeTestConfig(source, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(config.ServerConfig{
+		StorageURL: "mem://",
+		Users:      []config.UserConfig{user("removed"), mfa},
+	})
+	defer os.Remove(source)
+
+	//the config is only reloaded on SIGHUP
+	cli, out := startCLI(t, nil, "server", "-k", "testdata/id_rsa", "-c", source, "--bind-addr", "127.0.0.1", "-p", "2040",
+		"--config-poll-interval", "0", "--disconnect-removed-users", "--max-auth-failures", "-1", "--auth-failure-delay", "-1ns")
+	defer cli.Process.Kill()
+	dial := func(name string, auth ...ssh.AuthMethod) (*ssh.Client, error) {
+		return ssh.Dial("tcp", "127.0.0.1:2040", &ssh.ClientConfig{
+			User:            name,
+			Auth:            append([]ssh.AuthMethod{ssh.Password("reloadpassword")}, auth...),
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+	hangup := func(reloads int) {
+		if err := cli.Process.Signal(syscall.SIGHUP); err != nil {
+			t.Fatalf("Failed to send SIGHUP %v", err)
+		}
+		waitForOutput(t, out, "Reloaded config after SIGHUP", reloads)
+	}
+
+	removed, err := dial("removed")
+	if err != nil {
+		t.Fatalf("Could not sign in ssh.Dial failed %v", err)
+	}
+	defer removed.Close()
+	code, err := config.TOTPCode(totpSecret, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate totp code %v", err)
+	}
+	answer := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{code}, nil
+	})
+	signedIn, err := dial("mfa", answer)
+	if err != nil {
+		t.Fatalf("Could not sign in with password and totp code ssh.Dial failed %v", err)
+	}
+	signedIn.Close()
+
+	//the added user can sign in, the removed one is disconnected
+	write(config.ServerConfig{
+		StorageURL: "mem://",
+		Users:      []config.UserConfig{user("added"), mfa},
+	})
+	hangup(1)
+	waitForOutput(t, out, "Disconnected 1 connections of removed or disabled users", 1)
+	closed := make(chan struct{})
+	go func() {
+		removed.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the connection of the removed user to be closed")
+	}
+	if _, err := dial("removed"); err == nil {
+		t.Fatal("Expected the removed user to be refused")
+	}
+	added, err := dial("added")
+	if err != nil {
+		t.Fatalf("Could not sign in as a user added by a reload ssh.Dial failed %v", err)
+	}
+	added.Close()
+	if _, err := dial("mfa", answer); err == nil {
+		t.Fatal("Expected a totp code used before the reload to be refused")
+	}
+
+	//an invalid config is refused and the current one kept
+	write(config.ServerConfig{
+		StorageURL: "mem://",
+		Users:      []config.UserConfig{user("added"), {UserName: "invalid", PasswordHash: "not-a-bcrypt-hash"}},
+	})
+	if err := cli.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to send SIGHUP %v", err)
+	}
+	waitForOutput(t, out, "Failed to reload config after SIGHUP", 1)
+	if _, err := dial("invalid"); err == nil {
+		t.Fatal("Expected a user of a refused config to be unknown")
+	}
+	if !strings.Contains(out.String(), "field=\"users[1].password_hash\"") {
+		t.Fatalf("Expected the problem of the invalid config to be logged\n%v", out)
+	}
+
+	//a change of the networks applies to new connections
+	write(config.ServerConfig{
+		StorageURL:  "mem://",
+		Users:       []config.UserConfig{user("added")},
+		DeniedCIDRs: []string{"127.0.0.0/8"},
+	})
+	hangup(2)
+	if _, err := dial("added"); err == nil {
+		t.Fatal("Expected a connection from a network denied by a reload to be refused")
+	}
+
+	if err := cli.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to send SIGTERM %v", err)
+	}
+	if err := cli.Wait(); err != nil {
+		t.Fatalf("Expected the server to stop cleanly %v\n%v", err, out)
+	}
+}
+
+func TestE2EEnvironment(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("envpassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal("Failed to hash password")
+	}
+	source := "tmp/test-env-config.json"
+	if _, err := writeTestConfig(source, config.ServerConfig{
+		StorageURL: "mem://",
+		Upload:     &config.UploadConfig{BufferSize: 1024, PartSize: 6 << 20, Concurrency: 2},
+		Users:      []config.UserConfig{{UserName: "env", PasswordHash: string(passwordHash)}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(source)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageDir := path.Join(wd, "tmp/sftp-env")
+	if err := os.MkdirAll(storageDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storageDir)
+
+	//flags take precedence over the environment, which takes precedence over the config
+	cli, output := startCLI(t, []string{
+		"CLOUD_SFTP_PORT=2099",
+		"CLOUD_SFTP_BIND_ADDR=127.0.0.1",
+		"CLOUD_SFTP_STORAGE_URL=file://" + storageDir,
+		"CLOUD_SFTP_LOG_LEVEL=info",
+		"CLOUD_SFTP_UPLOAD_PART_SIZE=8388608",
+	}, "server", "-k", "testdata/id_rsa", "-c", source, "-p", "2041", "--upload-buffer-size", "4096")
+	defer cli.Process.Kill()
+	if !strings.Contains(output.String(), "Listening on 127.0.0.1:2041") {
+		t.Fatalf("Expected the port of the flag and the address of the environment\n%v", output)
+	}
+	//the upload block of the config only keeps the settings that weren't given otherwise
+	if !strings.Contains(output.String(), "buffer_size=4096 concurrency=2 part_size=8388608") {
+		t.Fatalf("Expected the upload buffer of the flag, the part size of the environment and the concurrency of the config\n%v", output)
+	}
+
+	conn, err := ssh.Dial("tcp", "127.0.0.1:2041", &ssh.ClientConfig{
+		User:            "env",
+		Auth:            []ssh.AuthMethod{ssh.Password("envpassword")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("Could not sign in ssh.Dial failed %v", err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Creating sftp client failed with %v", err)
+	}
+	defer client.Close()
+	if _, err := writeStrToRemoteFile(client, "env.txt", "from the environment"); err != nil {
+		t.Fatalf("Failed to write file %v", err)
+	}
+	if d, err := ioutil.ReadFile(path.Join(storageDir, "env.txt")); err != nil || string(d) != "from the environment" {
+		t.Fatalf("Expected the file in the storage url of the environment, got %q %v", d, err)
+	}
+
+	//sessions keep the log level that was asked for
+	if strings.Contains(output.String(), "level=debug") {
+		t.Fatalf("Expected no debug logs at level info\n%v", output)
+	}
+
+	//a variable that isn't a valid value of its flag stops the command
+	invalid := exec.Command(cliPath, "server", "-k", "testdata/id_rsa", "-c", source)
+	invalid.Env = append(os.Environ(), "CLOUD_SFTP_PORT=twenty-two")
+	out, err := invalid.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "Invalid CLOUD_SFTP_PORT") {
+		t.Fatalf("Expected an invalid CLOUD_SFTP_PORT to be refused, got %v %s", err, out)
+	}
+}
+
+//cliPath is the cloud-sftp binary built by startCLI
+var cliPath = "tmp/cloud-sftp-e2e"
+var buildCLI sync.Once
+
+//startCLI runs the cloud-sftp command with args and env once it has been built, it returns when the
+//server is listening
+func startCLI(t *testing.T, env []string, args ...string) (*exec.Cmd, *syncBuffer) {
+	var buildErr error
+	buildCLI.Do(func() {
+		out, err := exec.Command("go", "build", "-o", cliPath, ".").CombinedOutput()
+		if err != nil {
+			buildErr = fmt.Errorf("%v %s", err, out)
+		}
+	})
+	if buildErr != nil {
+		t.Fatalf("Failed to build cloud-sftp %v", buildErr)
+	}
+
+	out := &syncBuffer{}
+	cli := exec.Command(cliPath, args...)
+	cli.Env = append(os.Environ(), env...)
+	cli.Stdout = out
+	cli.Stderr = out
+	if err := cli.Start(); err != nil {
+		t.Fatalf("Failed to start cloud-sftp %v", err)
+	}
+	waitForOutput(t, out, "Listening on", 1)
+	return cli, out
+}
+
+//waitForOutput waits for text to have been written count times to out
+func waitForOutput(t *testing.T, out *syncBuffer, text string, count int) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if strings.Count(out.String(), text) >= count {
+			return
+		}
+	}
+	t.Fatalf("Expected %q in the output of cloud-sftp\n%v", text, out)
+}
+
+//syncBuffer is a bytes.Buffer written by a command while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestE2EConfigFormats(t *testing.T) {
+	for _, format := range []string{"yaml", "toml"} {
+		fixture, err := ioutil.ReadFile("testdata/config." + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source := "tmp/test-formats-config." + format
+		if err := ioutil.WriteFile(source, fixture, 0700); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(source)
+		provider, err := config.ParseConfigSource(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problems, err := provider.Validate(false); err != nil || len(problems) != 0 {
+			t.Fatalf("Expected the %v fixture to be valid, got %v %v", format, problems, err)
+		}
+		before, err := provider.ReadConfig()
+		if err != nil {
+			t.Fatalf("Failed to read %v config %v", format, err)
+		}
+		if len(before.Users) != 2 || before.Upload.PartSize != 5<<20 || before.Users[0].PublicKeys[0].Expires.Year() != 2030 {
+			t.Fatalf("Expected the %v fixture to be decoded, got %+v", format, before)
+		}
+
+		//the config is written back in its format, with nothing but the added user changed
+		if err := provider.AddUser("added", "addedpassword", []byte{}); err != nil {
+			t.Fatalf("Failed to add user to %v config %v", format, err)
+		}
+		after, err := provider.ReadConfig()
+		if err != nil {
+			t.Fatalf("Failed to read written %v config %v", format, err)
+		}
+		if len(after.Users) != 3 || after.Users[2].UserName != "added" {
+			t.Fatalf("Expected the user to be added to the %v config, got %+v", format, after.Users)
+		}
+		after.Users = after.Users[:2]
+		if !reflect.DeepEqual(before, after) {
+			t.Fatalf("Expected the %v config to be kept\n%+v\n%+v", format, before, after)
+		}
+		if problems, err := provider.Validate(false); err != nil || len(problems) != 0 {
+			t.Fatalf("Expected the written %v config to be valid, got %v %v", format, problems, err)
+		}
+	}
+
+	//comments stay with their keys
+	written, err := ioutil.ReadFile("tmp/test-formats-config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lines := range []string{
+		"storage_url: mem:// # the bucket\n",
+		"  part_size: 5242880 # 5MB\n",
+		"# the users\nusers:\n  # alice is a partner dropping reports\n  - username: alice\n",
+		"    permissions: [read, list] # read only\n    groups:\n      - partners # every partner\n",
+		"    disabled: true # left the company\n",
+		"  - path: /reports # partners only see reports\n",
+		"  - username: added\n",
+	} {
+		if !strings.Contains(string(written), lines) {
+			t.Fatalf("Expected the written yaml to contain %q\n%s", lines, written)
+		}
+	}
+}
@@ -1,14 +1,42 @@
 module github.com/shidel-dev/cloud-sftp
 
-go 1.12
+go 1.20
 
 require (
+	github.com/Azure/azure-storage-blob-go v0.8.0
+	github.com/BurntSushi/toml v1.3.2
 	github.com/aws/aws-sdk-go v1.19.45
-	github.com/eikenb/pipeat v0.0.0-20190316224601-fb1f3a9aa29f
+	github.com/eikenb/pipeat v0.0.0-20210730190139-06b3e6902001
 	github.com/google/uuid v1.1.1
-	github.com/pkg/sftp v1.11.0
+	github.com/pkg/sftp v1.13.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	gocloud.dev v0.18.1-0.20200112195325-f36e60584676
-	golang.org/x/crypto v0.0.0-20200109152110-61a87790db17
+	golang.org/x/crypto v0.31.0
+	golang.org/x/term v0.27.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	cloud.google.com/go v0.39.0 // indirect
+	github.com/Azure/azure-pipeline-go v0.2.1 // indirect
+	github.com/golang/groupcache v0.0.0-20190702054246-869f871628b6 // indirect
+	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/google/wire v0.3.0 // indirect
+	github.com/googleapis/gax-go v2.0.2+incompatible // indirect
+	github.com/googleapis/gax-go/v2 v2.0.4 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/mattn/go-ieproxy v0.0.0-20190610004146-91bb50d98149 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	go.opencensus.io v0.22.2 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7 // indirect
+	google.golang.org/api v0.6.0 // indirect
+	google.golang.org/genproto v0.0.0-20190620144150-6af8c5fc6601 // indirect
+	google.golang.org/grpc v1.21.1 // indirect
 )
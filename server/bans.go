@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	//DefaultMaxAuthFailures is the number of failed sign ins within the window before a client ip or username is banned
+	DefaultMaxAuthFailures = 5
+	//DefaultAuthFailureWindow is the sliding window failed sign ins are counted in
+	DefaultAuthFailureWindow = 5 * time.Minute
+	//DefaultBanDuration is how long a client ip or username stays banned
+	DefaultBanDuration = 15 * time.Minute
+	//DefaultAuthFailureDelay is the delay after the first failed sign in, it doubles with each further failure
+	DefaultAuthFailureDelay = 250 * time.Millisecond
+
+	maxAuthFailureDelay = 10 * time.Second
+)
+
+var (
+	authFailures = expvar.NewInt("server_auth_failures")
+	bansIssued   = expvar.NewInt("server_bans")
+)
+
+//Ban keeps a client ip or a username from signing in until it expires
+type Ban struct {
+	//Kind is "ip" or "user"
+	Kind     string    `json:"kind"`
+	Value    string    `json:"value"`
+	Until    time.Time `json:"until"`
+	Failures int       `json:"failures"`
+}
+
+func (b *Ban) key() string {
+	return b.Kind + "\x00" + b.Value
+}
+
+//Bans counts failed sign ins per client ip and username, and bans those failing too often
+type Bans struct {
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	delay       time.Duration
+
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	bans      map[string]*Ban
+	lastSweep time.Time
+}
+
+//NewBans creates Bans, zero values fall back to the defaults and negative maxFailures disables banning
+func NewBans(maxFailures int, window time.Duration, duration time.Duration, delay time.Duration) *Bans {
+	if maxFailures == 0 {
+		maxFailures = DefaultMaxAuthFailures
+	}
+	if window <= 0 {
+		window = DefaultAuthFailureWindow
+	}
+	if duration <= 0 {
+		duration = DefaultBanDuration
+	}
+	if delay == 0 {
+		delay = DefaultAuthFailureDelay
+	}
+	return &Bans{
+		maxFailures: maxFailures,
+		window:      window,
+		duration:    duration,
+		delay:       delay,
+		failures:    map[string][]time.Time{},
+		bans:        map[string]*Ban{},
+	}
+}
+
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+//banned returns the ban of kind on value, or nil. Expired bans are lifted.
+func (b *Bans) banned(kind string, value string) *Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := (&Ban{Kind: kind, Value: value}).key()
+	ban, ok := b.bans[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(ban.Until) {
+		delete(b.bans, key)
+		log.WithFields(log.Fields{"kind": kind, "value": value}).Info("Ban expired")
+		return nil
+	}
+	return ban
+}
+
+//check returns the ban keeping the user of conn from signing in, or nil
+func (b *Bans) check(conn ssh.ConnMetadata) *Ban {
+	if ban := b.banned("ip", clientIP(conn.RemoteAddr())); ban != nil {
+		return ban
+	}
+	return b.banned("user", conn.User())
+}
+
+//fail records a failed sign in of conn and returns how long to wait before answering
+func (b *Bans) fail(conn ssh.ConnMetadata) time.Duration {
+	authFailures.Add(1)
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(now)
+
+	n := 0
+	for _, ban := range []*Ban{{Kind: "ip", Value: clientIP(conn.RemoteAddr())}, {Kind: "user", Value: conn.User()}} {
+		failures := append(b.recent(ban.key(), now), now)
+		b.failures[ban.key()] = failures
+		if len(failures) > n {
+			n = len(failures)
+		}
+		if b.maxFailures < 0 || len(failures) < b.maxFailures {
+			continue
+		}
+		if _, ok := b.bans[ban.key()]; ok {
+			continue
+		}
+		ban.Until = now.Add(b.duration)
+		ban.Failures = len(failures)
+		b.bans[ban.key()] = ban
+		bansIssued.Add(1)
+		log.WithFields(log.Fields{"kind": ban.Kind, "value": ban.Value, "until": ban.Until, "failures": ban.Failures}).Warn("Banned after failed sign ins")
+	}
+
+	if b.delay < 0 {
+		return 0
+	}
+	delay := b.delay
+	for i := 1; i < n && delay < maxAuthFailureDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxAuthFailureDelay {
+		delay = maxAuthFailureDelay
+	}
+	return delay
+}
+
+//succeed forgets the failed sign ins of the user of conn. Those of the client ip are kept, otherwise
+//signing in to one account would reset the count of an ip guessing the passwords of others.
+func (b *Bans) succeed(conn ssh.ConnMetadata) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, (&Ban{Kind: "user", Value: conn.User()}).key())
+}
+
+//recent returns the failures of key within the window
+func (b *Bans) recent(key string, now time.Time) []time.Time {
+	failures := b.failures[key]
+	i := 0
+	for i < len(failures) && now.Sub(failures[i]) > b.window {
+		i++
+	}
+	return failures[i:]
+}
+
+//sweep drops the failures and bans that have expired, at most once per window
+func (b *Bans) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.window {
+		return
+	}
+	b.lastSweep = now
+	for key := range b.failures {
+		if len(b.recent(key, now)) == 0 {
+			delete(b.failures, key)
+		}
+	}
+	for key, ban := range b.bans {
+		if now.After(ban.Until) {
+			delete(b.bans, key)
+			log.WithFields(log.Fields{"kind": ban.Kind, "value": ban.Value}).Info("Ban expired")
+		}
+	}
+}
+
+//List returns the bans in effect
+func (b *Bans) List() []Ban {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bans := []Ban{}
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+//Clear lifts the bans matching kind and value along with their failures, empty values match every ban
+func (b *Bans) Clear(kind string, value string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cleared := 0
+	for key, ban := range b.bans {
+		if (len(kind) != 0 && ban.Kind != kind) || (len(value) != 0 && ban.Value != value) {
+			continue
+		}
+		delete(b.bans, key)
+		delete(b.failures, key)
+		cleared++
+		log.WithFields(log.Fields{"kind": ban.Kind, "value": ban.Value}).Info("Ban cleared")
+	}
+	return cleared
+}
+
+//ServeHTTP lists the bans on GET and clears them on DELETE, optionally limited by the kind and value query
+//parameters. The admin server only lets DELETE through with the admin token.
+func (b *Bans) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.List())
+	case http.MethodDelete:
+		cleared := b.Clear(r.URL.Query().Get("kind"), r.URL.Query().Get("value"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"cleared": cleared})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
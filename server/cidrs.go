@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+//ParseCIDRs parses IPv4 and IPv6 CIDRs, a single address stands for a network holding only it
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid CIDR %v", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %v", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+//ContainsAddr reports whether the ip of addr is in one of networks
+func ContainsAddr(networks []*net.IPNet, addr net.Addr) bool {
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//sourceFilter accepts connections from the allowed networks, or from anywhere when none are given, unless they
+//come from a denied network
+type sourceFilter struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+func newSourceFilter(allowed []string, denied []string) (*sourceFilter, error) {
+	a, err := ParseCIDRs(allowed)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ParseCIDRs(denied)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceFilter{allowed: a, denied: d}, nil
+}
+
+func (f *sourceFilter) accepts(addr net.Addr) bool {
+	if ContainsAddr(f.denied, addr) {
+		return false
+	}
+	return len(f.allowed) == 0 || ContainsAddr(f.allowed, addr)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/shidel-dev/cloud-sftp/cloudfs"
+	"golang.org/x/crypto/ssh"
+)
+
+//connState follows a connection being served, so Shutdown can tell the idle ones from those uploading
+type connState struct {
+	mu    sync.Mutex
+	sconn *ssh.ServerConn
+	fss   []*cloudfs.CloudFs
+}
+
+//signedIn records the ssh connection once its handshake succeeded
+func (c *connState) signedIn(sconn *ssh.ServerConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sconn = sconn
+}
+
+//conn returns the ssh connection, nil while it is in its handshake
+func (c *connState) conn() *ssh.ServerConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sconn
+}
+
+//serving records the file system of a sftp session of the connection
+func (c *connState) serving(fs *cloudfs.CloudFs) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fss = append(c.fss, fs)
+}
+
+//uploading tells if a session of the connection has a file open for writing
+func (c *connState) uploading() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fs := range c.fss {
+		if fs.Uploads() > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+//limits bounds the connections served at once, those still in their handshake and the authenticated
+//ones in total and per client ip and username. Zero values are unlimited.
+type limits struct {
+	maxPending int
+	maxTotal   int
+	maxPerIP   int
+	maxPerUser int
+
+	mu      sync.Mutex
+	pending int
+	total   int
+	perIP   map[string]int
+	perUser map[string]int
+}
+
+func newLimits(c *Config) *limits {
+	return &limits{
+		maxPending: c.MaxPendingConnections,
+		maxTotal:   c.MaxConnections,
+		maxPerIP:   c.MaxConnectionsPerIP,
+		maxPerUser: c.MaxConnectionsPerUser,
+		perIP:      map[string]int{},
+		perUser:    map[string]int{},
+	}
+}
+
+//accept counts a new connection until its handshake ends, it returns false when as many connections
+//as may be are already in their handshake
+func (l *limits) accept() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxPending > 0 && l.pending >= l.maxPending {
+		return false
+	}
+	l.pending++
+	return true
+}
+
+//handshaken must be called once for each accepted connection when its handshake ends
+func (l *limits) handshaken() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending--
+}
+
+//admit counts an authenticated connection of user from ip. It returns why it is refused, or a func
+//to call once it is closed.
+func (l *limits) admit(ip string, user string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return nil, fmt.Errorf("the server is serving as many connections as it may, %v, try again later", l.maxTotal)
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return nil, fmt.Errorf("too many connections from %v, at most %v are allowed", ip, l.maxPerIP)
+	}
+	if l.maxPerUser > 0 && l.perUser[user] >= l.maxPerUser {
+		return nil, fmt.Errorf("too many connections for user %v, at most %v are allowed", user, l.maxPerUser)
+	}
+	l.total++
+	l.perIP[ip]++
+	l.perUser[user]++
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.total--
+		if l.perIP[ip]--; l.perIP[ip] == 0 {
+			delete(l.perIP, ip)
+		}
+		if l.perUser[user]--; l.perUser[user] == 0 {
+			delete(l.perUser, user)
+		}
+	}, nil
+}
@@ -2,10 +2,15 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -17,57 +22,238 @@ import (
 
 //Config configuration for a sftp server
 type Config struct {
-	HostKey               ssh.Signer
-	BindAddr              string
-	Port                  int
-	PasswordCallback      PasswordCallback
-	PublicKeyCallback     PublicKeyCallback
+	HostKey           ssh.Signer
+	BindAddr          string
+	Port              int
+	PasswordCallback  PasswordCallback
+	PublicKeyCallback PublicKeyCallback
+	//KeyboardInteractiveCallback authenticates a ssh connection on its own by asking the client questions
+	KeyboardInteractiveCallback KeyboardInteractiveCallback
+	//SecondFactorCallback is asked by keyboard-interactive after a callback returns ErrSecondFactorRequired
+	SecondFactorCallback  KeyboardInteractiveCallback
 	BucketCallback        BucketCallback
 	NewServerConnCallback NewServerConnCallback
+	ConnClosedCallback    ConnClosedCallback
+	UploadOptionsCallback UploadOptionsCallback
+	AuthorizerCallback    AuthorizerCallback
+	MountsCallback        MountsCallback
 	StorageURL            string
+	//StagingDir is where files opened for reading and writing are held until they are uploaded
+	StagingDir string
+	//StagingMaxBytes bounds the local disk space used by StagingDir
+	StagingMaxBytes int64
+	//StagingMaxFiles bounds the number of files that can be open for reading and writing at once
+	StagingMaxFiles int
+	//CacheDir is where the contents of blobs that are read are cached
+	CacheDir string
+	//CacheMaxBytes bounds the size of the read cache, the cache is disabled when it is 0
+	CacheMaxBytes int64
+	//PrefetchChunkSize is the size of each range fetched ahead of a sequential download
+	PrefetchChunkSize int64
+	//PrefetchPerFile is the number of ranges fetched concurrently for one file, prefetching is disabled when it is negative
+	PrefetchPerFile int
+	//PrefetchTotal is the number of ranges fetched concurrently across every session
+	PrefetchTotal int
+	//PrefetchMaxMemory bounds the memory holding prefetched ranges across every session
+	PrefetchMaxMemory int64
+	//PrefetchMinSize is the size a file must have before its downloads are prefetched
+	PrefetchMinSize int64
+	//SpillDir is where uploads written out of order are buffered until they can be streamed to the bucket
+	SpillDir string
+	//SpillMaxBytes bounds the local disk space used by SpillDir
+	SpillMaxBytes int64
+	//ReorderWindow is the memory each upload may use to hold writes that arrive out of order before spilling to disk
+	ReorderWindow int
+	//UploadBufferSize is the size of the buffer collecting client writes before they are handed to the bucket
+	UploadBufferSize int
+	//UploadPartSize is the size of each S3 part, Azure block or GCS chunk uploaded in a single request
+	UploadPartSize int
+	//UploadConcurrency is the number of Azure blocks uploaded in parallel
+	UploadConcurrency int
+	//AdminAddr is the address of an http server exposing metrics at /debug/vars and bans at /bans, it is disabled when empty
+	AdminAddr string
+	//AdminToken must be sent as a bearer token to clear bans at /bans. Without one bans can only be
+	//cleared from the loopback interface.
+	AdminToken string
+	//MaxAuthFailures is the number of failed sign ins within AuthFailureWindow before a client ip or username is banned,
+	//banning is disabled when it is negative
+	MaxAuthFailures int
+	//AuthFailureWindow is the sliding window failed sign ins are counted in
+	AuthFailureWindow time.Duration
+	//BanDuration is how long a client ip or username stays banned
+	BanDuration time.Duration
+	//AuthFailureDelay is the delay after a failed password or code, it doubles with each further failure and is disabled when negative
+	AuthFailureDelay time.Duration
+	//AllowedCIDRs are the networks clients may connect from, every network is allowed when it is empty
+	AllowedCIDRs []string
+	//DeniedCIDRs are the networks clients may not connect from, they take precedence over AllowedCIDRs
+	DeniedCIDRs []string
+	//MaxConnections bounds the authenticated connections served at once, further ones are told so when
+	//they open a session and closed
+	MaxConnections int
+	//MaxPendingConnections bounds the connections that haven't finished their handshake, further ones
+	//are closed as they connect
+	MaxPendingConnections int
+	//HandshakeTimeout closes connections that haven't authenticated this long after connecting. It
+	//defaults to DefaultHandshakeTimeout and is disabled when negative.
+	HandshakeTimeout time.Duration
+	//MaxConnectionsPerIP bounds the authenticated connections from one client ip
+	MaxConnectionsPerIP int
+	//MaxConnectionsPerUser bounds the authenticated connections of one user
+	MaxConnectionsPerUser int
+	//MaxChannelsPerConnection bounds the sftp sessions opened at once on one connection
+	MaxChannelsPerConnection int
+	//IdleTimeout closes connections that sent or received no sftp packet for this long, it is disabled when 0
+	IdleTimeout time.Duration
+	//MaxSessionDuration closes connections this long after they authenticated, it is disabled when 0
+	MaxSessionDuration time.Duration
+	//KeepaliveInterval is how often clients are sent a keepalive request, it is disabled when 0
+	KeepaliveInterval time.Duration
+	//KeepaliveCountMax is the number of unanswered keepalives after which the connection is closed
+	KeepaliveCountMax int
 }
 
-//PasswordCallback authenticates a ssh connection by password
-type PasswordCallback func(c ssh.ConnMetadata, pass []byte) error
+//DefaultHandshakeTimeout is how long a connection has to authenticate, it matches the LoginGraceTime of OpenSSH
+const DefaultHandshakeTimeout = 2 * time.Minute
 
-//PublicKeyCallback authenticates a ssh connection given a public key
-type PublicKeyCallback func(conn ssh.ConnMetadata, key ssh.PublicKey) error
+//PasswordCallback authenticates a ssh connection by password. The permissions it returns are those of
+//the connection, see Permissions.
+type PasswordCallback func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error)
+
+//PublicKeyCallback authenticates a ssh connection given a public key. Clients may ask about a key
+//without proving they hold it, the permissions returned for the key they sign with are those of the
+//connection.
+type PublicKeyCallback func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+
+//KeyboardInteractiveCallback authenticates a ssh connection with the answers to challenges
+type KeyboardInteractiveCallback func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)
+
+//Permissions returns the permissions returned by the callback that authenticated conn, the
+//connection given to the callbacks called after sign in. It is nil for other connections.
+func Permissions(conn ssh.ConnMetadata) *ssh.Permissions {
+	if sconn, ok := conn.(*ssh.ServerConn); ok {
+		return sconn.Permissions
+	}
+	return nil
+}
+
+//ErrSecondFactorRequired is returned by PasswordCallback or PublicKeyCallback when the first factor is
+//correct, the connection is then authenticated by SecondFactorCallback
+var ErrSecondFactorRequired = errors.New("second factor required")
 
 //BucketCallback returns a pointer to a blob.Bucket to be used for the duration of the sftp session
 type BucketCallback func(conn ssh.ConnMetadata) (*blob.Bucket, error)
 
+//UploadOptionsCallback returns the upload tuning for a ssh connection, zero values fall back to the server's settings
+type UploadOptionsCallback func(conn ssh.ConnMetadata) cloudfs.UploadOptions
+
+//AuthorizerCallback returns what a ssh connection is allowed to do, every operation is allowed when it returns nil
+type AuthorizerCallback func(conn ssh.ConnMetadata) cloudfs.Authorizer
+
+//MountsCallback returns the buckets making up the file system of a ssh connection. When it returns no mounts
+//the session is served from the bucket of BucketCallback or StorageURL.
+type MountsCallback func(conn ssh.ConnMetadata) ([]cloudfs.Mount, error)
+
 //NewServerConnCallback is called when a new ssh server connection is created
 type NewServerConnCallback func(scon *ssh.ServerConn)
 
+//ConnClosedCallback is called when a connection that attempted to authenticate is closed
+type ConnClosedCallback func(conn ssh.ConnMetadata)
+
 //Server Creates/Operates a sftp server
 type Server struct {
+	//mu guards config, sources, listener, closing and conns
+	mu       sync.Mutex
 	config   *Config
-	running  bool
+	sources  *sourceFilter
 	listener *net.TCPListener
-	wg       *sync.WaitGroup
+	closing  bool
+	conns    map[net.Conn]*connState
+	//wg counts the connections being served, active mirrors it for reporting
+	wg     sync.WaitGroup
+	active int32
+	//ctx is cancelled when the connections still open after the grace period of Shutdown are cut
+	ctx      context.Context
+	cancel   context.CancelFunc
+	staging  *cloudfs.Staging
+	cache    *cloudfs.Cache
+	prefetch *cloudfs.Prefetcher
+	spill    *cloudfs.Spill
+	bans     *Bans
+	limits   *limits
 }
 
 //New Creates a Server
 func New(config *Config) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  map[net.Conn]*connState{},
+		bans:   NewBans(config.MaxAuthFailures, config.AuthFailureWindow, config.BanDuration, config.AuthFailureDelay),
+		limits: newLimits(config),
 	}
 }
 
+//Bans returns the client ips and usernames banned after failed sign ins
+func (s *Server) Bans() *Bans {
+	return s.bans
+}
+
 //ListenAndServe listens on the TCP network address specified by BindAddr,and Port. It serves sftp requests based on the provided Config
 func (s *Server) ListenAndServe(cond *sync.Cond) error {
 	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%v:%v", s.config.BindAddr, s.config.Port))
 	if err != nil {
 		return fmt.Errorf("fail to resolve addr: %v", err)
 	}
+	staging, err := cloudfs.NewStaging(s.config.StagingDir, s.config.StagingMaxBytes, s.config.StagingMaxFiles)
+	if err != nil {
+		return fmt.Errorf("failed to create staging dir: %v", err)
+	}
+	s.staging = staging
+
+	if s.config.CacheMaxBytes > 0 {
+		cache, err := cloudfs.NewCache(s.config.CacheDir, s.config.CacheMaxBytes)
+		if err != nil {
+			return fmt.Errorf("failed to create cache dir: %v", err)
+		}
+		s.cache = cache
+	}
+
+	spill, err := cloudfs.NewSpill(s.config.SpillDir, s.config.SpillMaxBytes, s.config.ReorderWindow)
+	if err != nil {
+		return fmt.Errorf("failed to create spill dir: %v", err)
+	}
+	s.spill = spill
+
+	if s.config.PrefetchPerFile >= 0 {
+		s.prefetch = cloudfs.NewPrefetcher(s.config.PrefetchChunkSize, s.config.PrefetchPerFile, s.config.PrefetchTotal, s.config.PrefetchMaxMemory, s.config.PrefetchMinSize)
+	}
+
+	sources, err := newSourceFilter(s.config.AllowedCIDRs, s.config.DeniedCIDRs)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sources = sources
+	s.mu.Unlock()
+
+	if len(s.config.AdminAddr) != 0 {
+		go s.serveAdmin()
+	}
 	listener, err := net.ListenTCP("tcp", addr)
 	if err != nil {
 		log.Fatal("failed to listen for connection ", err)
 	}
 	defer listener.Close()
-	s.wg = &sync.WaitGroup{}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return nil
+	}
 	s.listener = listener
-	s.running = true
+	s.mu.Unlock()
 	fmt.Printf("Listening on %v\n", listener.Addr())
 	if cond != nil {
 		cond.Broadcast()
@@ -75,48 +261,252 @@ func (s *Server) ListenAndServe(cond *sync.Cond) error {
 	for {
 		nConn, err := listener.Accept()
 		if err != nil {
-			if !s.running {
+			if s.isClosing() {
 				break
 			}
 			log.Error("failed to accept incoming connection ", err)
+			continue
 		}
 
+		if !s.accepts(nConn.RemoteAddr()) {
+			log.WithField("addr", nConn.RemoteAddr()).Warn("Refused connection from a network that is not allowed")
+			nConn.Close()
+			continue
+		}
+		if !s.limits.accept() {
+			log.WithField("addr", nConn.RemoteAddr()).Warnf("Refused connection, %v connections are already in their handshake", s.limits.maxPending)
+			nConn.Write([]byte("Too many connections are signing in, try again later\r\n"))
+			nConn.Close()
+			continue
+		}
+
+		//connections are only counted while the server is open, so Shutdown never waits on one added later
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			s.limits.handshaken()
+			nConn.Close()
+			break
+		}
+		s.wg.Add(1)
+		atomic.AddInt32(&s.active, 1)
+		s.mu.Unlock()
 		go s.serve(nConn)
 	}
 	return nil
 }
 
+//current returns the config new connections are served with
+func (s *Server) current() *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+//Reload serves new connections with config, and accepts them from its allowed and denied networks.
+//The listener and the staging, cache, prefetch and spill settings are kept from the config the server
+//was started with, as are bans and connection limits. A config with invalid networks is not applied.
+func (s *Server) Reload(config *Config) error {
+	sources, err := newSourceFilter(config.AllowedCIDRs, config.DeniedCIDRs)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.sources = sources
+	return nil
+}
+
+//accepts tells if connections from addr are allowed by the current config
+func (s *Server) accepts(addr net.Addr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sources.accepts(addr)
+}
+
+//Disconnect closes the authenticated connections matching filter and returns how many were closed
+func (s *Server) Disconnect(filter func(conn ssh.ConnMetadata) bool) int {
+	s.mu.Lock()
+	matched := []*ssh.ServerConn{}
+	for _, state := range s.conns {
+		if sconn := state.conn(); sconn != nil && filter(sconn) {
+			matched = append(matched, sconn)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sconn := range matched {
+		log.WithFields(log.Fields{"user": sconn.User(), "addr": sconn.RemoteAddr()}).Info("Disconnecting")
+		sconn.Close()
+	}
+	return len(matched)
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+//guard refuses banned clients and records the outcome of authenticate, failed is called when it fails
+func (s *Server) guard(conn ssh.ConnMetadata, authenticate func() (*ssh.Permissions, error), failed func()) (*ssh.Permissions, error) {
+	if ban := s.bans.check(conn); ban != nil {
+		log.WithFields(log.Fields{"user": conn.User(), "addr": conn.RemoteAddr()}).Warnf("Refused sign in, %v %v is banned", ban.Kind, ban.Value)
+		return nil, errors.New("banned")
+	}
+
+	permissions, err := authenticate()
+	if err == nil {
+		s.bans.succeed(conn)
+		return permissions, nil
+	}
+	if err == ErrSecondFactorRequired {
+		return permissions, err
+	}
+
+	log.WithFields(log.Fields{"user": conn.User(), "addr": conn.RemoteAddr()}).Infof("Failed sign in %v", err)
+	failed()
+	return nil, err
+}
+
+//failed records a failed password or code and delays the answer
+func (s *Server) failed(conn ssh.ConnMetadata) func() {
+	return func() {
+		time.Sleep(s.bans.fail(conn))
+	}
+}
+
+//secondFactor turns ErrSecondFactorRequired into a partial success that continues with SecondFactorCallback.
+//The connection keeps the permissions of the first factor unless the second factor returns its own.
+func (s *Server) secondFactor(cfg *Config, permissions *ssh.Permissions, err error) (*ssh.Permissions, error) {
+	if err != ErrSecondFactorRequired {
+		return permissions, err
+	}
+	if cfg.SecondFactorCallback == nil {
+		return nil, errors.New("Missing second factor callback")
+	}
+	return nil, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				second, err := s.guard(c, func() (*ssh.Permissions, error) {
+					return cfg.SecondFactorCallback(c, client)
+				}, s.failed(c))
+				if err != nil || second != nil {
+					return second, err
+				}
+				return permissions, nil
+			},
+		},
+	}
+}
+
 func (s *Server) serve(conn net.Conn) {
-	s.wg.Add(1)
-	defer conn.Close()
+	//a connection keeps the config it was accepted with, reloads apply to new connections
+	cfg := s.current()
 	defer s.wg.Done()
+	defer atomic.AddInt32(&s.active, -1)
+	defer conn.Close()
+	state := &connState{}
+	s.mu.Lock()
+	s.conns[conn] = state
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	//the connection counts as pending until its handshake ends
+	pending := true
+	defer func() {
+		if pending {
+			s.limits.handshaken()
+		}
+	}()
+
+	//cancelling the server cuts the connection, the sftp sessions then abort their in-flight uploads
+	served := make(chan struct{})
+	defer close(served)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+		case <-served:
+		}
+	}()
+
+	//banned addresses are dropped before the handshake
+	if ban := s.bans.banned("ip", clientIP(conn.RemoteAddr())); ban != nil {
+		log.WithField("addr", conn.RemoteAddr()).Debugf("Dropped connection, ip is banned until %v", ban.Until)
+		return
+	}
 	config := &ssh.ServerConfig{}
 	var connectionMetadata ssh.ConnMetadata
+	//clients offer each of their keys in turn, so rejected keys only count as one failure once the handshake fails
+	var keyFailed ssh.ConnMetadata
+	defer func() {
+		if connectionMetadata != nil && cfg.ConnClosedCallback != nil {
+			cfg.ConnClosedCallback(connectionMetadata)
+		}
+	}()
 
-	if s.config.PasswordCallback != nil {
+	if cfg.PasswordCallback != nil {
 		config.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 			connectionMetadata = c
-			return nil, s.config.PasswordCallback(c, pass)
+			permissions, err := s.guard(c, func() (*ssh.Permissions, error) {
+				return cfg.PasswordCallback(c, pass)
+			}, s.failed(c))
+			return s.secondFactor(cfg, permissions, err)
 		}
 	}
 
-	if s.config.PublicKeyCallback != nil {
+	if cfg.PublicKeyCallback != nil {
 		config.PublicKeyCallback = func(c ssh.ConnMetadata, pk ssh.PublicKey) (*ssh.Permissions, error) {
 			connectionMetadata = c
-			return nil, s.config.PublicKeyCallback(c, pk)
+			permissions, err := s.guard(c, func() (*ssh.Permissions, error) {
+				return cfg.PublicKeyCallback(c, pk)
+			}, func() {
+				keyFailed = c
+			})
+			return s.secondFactor(cfg, permissions, err)
+		}
+	}
+
+	if cfg.KeyboardInteractiveCallback != nil {
+		config.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			connectionMetadata = c
+			permissions, err := s.guard(c, func() (*ssh.Permissions, error) {
+				return cfg.KeyboardInteractiveCallback(c, client)
+			}, s.failed(c))
+			return s.secondFactor(cfg, permissions, err)
 		}
 	}
 
-	config.AddHostKey(s.config.HostKey)
+	config.AddHostKey(cfg.HostKey)
+	handshakeTimeout := cfg.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = DefaultHandshakeTimeout
+	}
+	if handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
 	// Before use, a handshake must be performed on the incoming net.Conn.
 	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	pending = false
+	s.limits.handshaken()
+	conn.SetDeadline(time.Time{})
 	if err != nil {
 		log.Error("failed to handshake ", err)
+		if keyFailed != nil {
+			s.bans.fail(keyFailed)
+		}
 		return
 	}
 
-	if s.config.NewServerConnCallback != nil {
-		s.config.NewServerConnCallback(sconn)
+	state.signedIn(sconn)
+
+	if cfg.NewServerConnCallback != nil {
+		cfg.NewServerConnCallback(sconn)
 	}
 	fmt.Printf("Login detected: %v", sconn.User())
 
@@ -124,6 +514,24 @@ func (s *Server) serve(conn net.Conn) {
 	go ssh.DiscardRequests(reqs)
 
 	// Service the incoming Channel channel.
+	release, err := s.limits.admit(clientIP(sconn.RemoteAddr()), sconn.User())
+	if err != nil {
+		log.WithFields(log.Fields{"user": sconn.User(), "addr": sconn.RemoteAddr()}).Warnf("Refused connection, %v", err)
+		//the client shows why its session could not be opened
+		for newChannel := range chans {
+			newChannel.Reject(ssh.ResourceShortage, err.Error())
+			return
+		}
+		return
+	}
+	defer release()
+
+	watch := newSessionWatch(sconn, cfg)
+	defer watch.stop()
+
+	var channels sync.WaitGroup
+	defer channels.Wait()
+	var open int32
 	for newChannel := range chans {
 		// Channels have a type, depending on the application level
 		// protocol intended. In the case of an SFTP session, this is "subsystem"
@@ -134,88 +542,248 @@ func (s *Server) serve(conn net.Conn) {
 			log.Debugf("Unknown channel type: %s\n", newChannel.ChannelType())
 			continue
 		}
+		if max := cfg.MaxChannelsPerConnection; max > 0 && int(atomic.LoadInt32(&open)) >= max {
+			newChannel.Reject(ssh.ResourceShortage, fmt.Sprintf("too many sftp sessions on this connection, at most %v are allowed", max))
+			continue
+		}
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
 			log.Fatal("could not accept channel.", err)
 		}
 		log.Debugf("Channel accepted\n")
 
-		// Sessions have out-of-band requests such as "shell",
-		// "pty-req" and "env".  Here we handle only the
-		// "subsystem" request.
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				log.Debugf("Request: %v\n", req.Type)
-				ok := false
-				switch req.Type {
-				case "subsystem":
-					log.Debugf("Subsystem: %s\n", req.Payload[4:])
-					if string(req.Payload[4:]) == "sftp" {
-						ok = true
-					}
-				}
-				log.Debugf(" - accepted: %v\n", ok)
-				req.Reply(ok, nil)
+		atomic.AddInt32(&open, 1)
+		channels.Add(1)
+		go func() {
+			defer channels.Done()
+			s.serveChannel(cfg, state, watch.channel(channel), requests, sconn)
+			//the connection ends with its last session
+			if atomic.AddInt32(&open, -1) == 0 {
+				sconn.Close()
 			}
-		}(requests)
-
-		log.SetLevel(log.DebugLevel)
-		taggedLogger := log.WithFields(log.Fields{
-			"bucket": "sftp",
-			"user":   "testuser",
-		})
+		}()
+	}
+}
 
-		var bucket *blob.Bucket
+//serveChannel serves a sftp session on channel until the client ends it
+func (s *Server) serveChannel(cfg *Config, state *connState, channel ssh.Channel, requests <-chan *ssh.Request, sconn *ssh.ServerConn) {
+	defer channel.Close()
 
-		if s.config.BucketCallback != nil {
-			bucket, err = s.config.BucketCallback(connectionMetadata)
-			if err != nil {
-				taggedLogger.Errorf("BucketCallback failed %v", err)
-				return
+	// Sessions have out-of-band requests such as "shell",
+	// "pty-req" and "env".  Here we handle only the
+	// "subsystem" request.
+	go func(in <-chan *ssh.Request) {
+		for req := range in {
+			log.Debugf("Request: %v\n", req.Type)
+			ok := false
+			switch req.Type {
+			case "subsystem":
+				log.Debugf("Subsystem: %s\n", req.Payload[4:])
+				if string(req.Payload[4:]) == "sftp" {
+					ok = true
+				}
 			}
-		} else {
-			driverURL := s.config.StorageURL
+			log.Debugf(" - accepted: %v\n", ok)
+			req.Reply(ok, nil)
+		}
+	}(requests)
 
-			if len(driverURL) == 0 {
-				log.Error("Missing DriverURL")
-				return
-			}
+	taggedLogger := log.WithFields(log.Fields{
+		"bucket": "sftp",
+		"user":   "testuser",
+	})
 
-			bucket, err = blob.OpenBucket(context.Background(), driverURL)
-			if err != nil {
-				taggedLogger.Errorf("Failed to OpenBucket %v", err)
-			}
+	var bucket *blob.Bucket
+	var mounts []cloudfs.Mount
+	var err error
+
+	if cfg.MountsCallback != nil {
+		mounts, err = cfg.MountsCallback(sconn)
+		if err != nil {
+			taggedLogger.Errorf("MountsCallback failed %v", err)
+			return
 		}
+	}
 
+	//mounted buckets are shared between sessions and stay open, otherwise the session gets its own bucket
+	var bucketID string
+	if len(mounts) == 0 {
+		bucket, err = s.openBucket(cfg, sconn, taggedLogger)
 		if err != nil {
 			log.Errorf("Failed to open bucket %v", err)
 			return
 		}
+		defer bucket.Close()
+		//buckets opened from the same url serve the same blobs, those of BucketCallback may not
+		if cfg.BucketCallback == nil {
+			bucketID = cfg.StorageURL
+		}
+	}
 
-		fs := cloudfs.New(bucket, taggedLogger)
-		handlers := sftp.Handlers{
-			FileGet:  fs,
-			FilePut:  fs,
-			FileList: fs,
-			FileCmd:  fs,
+	upload := cloudfs.UploadOptions{
+		BufferSize:  cfg.UploadBufferSize,
+		PartSize:    cfg.UploadPartSize,
+		Concurrency: cfg.UploadConcurrency,
+	}
+	if cfg.UploadOptionsCallback != nil {
+		upload = cfg.UploadOptionsCallback(sconn).Merge(upload)
+	}
+
+	var authorizer cloudfs.Authorizer
+	if cfg.AuthorizerCallback != nil {
+		authorizer = cfg.AuthorizerCallback(sconn)
+	}
+
+	fs := cloudfs.New(bucket, taggedLogger, cloudfs.Options{
+		Staging:    s.staging,
+		Cache:      s.cache,
+		Prefetcher: s.prefetch,
+		Spill:      s.spill,
+		Upload:     upload,
+		Authorizer: authorizer,
+		Mounts:     mounts,
+		BucketID:   bucketID,
+	})
+	state.serving(fs)
+	handlers := sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileList: fs,
+		FileCmd:  fs,
+	}
+	server := sftp.NewRequestServer(channel, handlers)
+	defer server.Close()
+
+	if err := server.Serve(); err != nil && err != io.EOF {
+		log.Errorf("sftp server completed with error: %v", err)
+	}
+}
+
+//openBucket opens the bucket serving a session without mounts
+func (s *Server) openBucket(cfg *Config, conn ssh.ConnMetadata, logger *log.Entry) (*blob.Bucket, error) {
+	if cfg.BucketCallback != nil {
+		bucket, err := cfg.BucketCallback(conn)
+		if err != nil {
+			logger.Errorf("BucketCallback failed %v", err)
 		}
-		server := sftp.NewRequestServer(channel, handlers)
+		return bucket, err
+	}
 
-		if err := server.Serve(); err == io.EOF {
-			bucket.Close()
-			server.Close()
-			break
-		} else if err != nil {
-			log.Errorf("sftp server completed with error: %v", err)
-			break
+	driverURL := cfg.StorageURL
+	if len(driverURL) == 0 {
+		return nil, errors.New("Missing DriverURL")
+	}
+
+	bucket, err := blob.OpenBucket(context.Background(), driverURL)
+	if err != nil {
+		logger.Errorf("Failed to OpenBucket %v", err)
+	}
+	return bucket, err
+}
+
+func (s *Server) serveAdmin() {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/bans", s.requireAdmin(s.bans))
+	err := http.ListenAndServe(s.config.AdminAddr, mux)
+	if err != nil {
+		log.Error("admin server failed ", err)
+	}
+}
+
+//requireAdmin refuses the requests that change something, anything but GET, without the admin token
+func (s *Server) requireAdmin(h http.Handler) http.Handler {
+	token := s.config.AdminToken
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !isAdmin(token, r) {
+			log.WithField("addr", r.RemoteAddr).Warnf("Refused %v %v without the admin token", r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong admin token", http.StatusUnauthorized)
+			return
 		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+//isAdmin reports whether r carries token, or comes from the loopback interface when there is no token
+func isAdmin(token string, r *http.Request) bool {
+	if len(token) == 0 {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+//ShutdownSummary tells how the connections open when Shutdown was called ended
+type ShutdownSummary struct {
+	//Drained connections were closed by their clients, or by the server once they had no uploads in flight,
+	//within the grace period
+	Drained int
+	//Cancelled connections were cut when the grace period ended, their in-flight uploads were aborted
+	Cancelled int
+}
+
+//Shutdown stops accepting connections and closes the open ones as soon as they have no files open for writing,
+//so only in-flight uploads hold it up. When ctx is done first the remaining connections are cancelled, and ctx's
+//error is returned.
+func (s *Server) Shutdown(ctx context.Context) (ShutdownSummary, error) {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	open := int(atomic.LoadInt32(&s.active))
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	//uploads start and end on their own, so idle connections are looked for until all are gone
+	tick := time.NewTicker(shutdownPollInterval)
+	defer tick.Stop()
+	for {
+		s.closeIdle()
+		select {
+		case <-drained:
+			return ShutdownSummary{Drained: open}, nil
+		case <-ctx.Done():
+			cancelled := int(atomic.LoadInt32(&s.active))
+			s.cancel()
+			<-drained
+			return ShutdownSummary{Drained: open - cancelled, Cancelled: cancelled}, ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+//shutdownPollInterval is how often Shutdown looks for connections whose uploads have ended
+const shutdownPollInterval = 100 * time.Millisecond
+
+//closeIdle closes the connections without files open for writing
+func (s *Server) closeIdle() {
+	s.mu.Lock()
+	idle := []net.Conn{}
+	for conn, state := range s.conns {
+		if !state.uploading() {
+			idle = append(idle, conn)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, conn := range idle {
+		log.WithField("addr", conn.RemoteAddr()).Debug("Closing idle connection to shut down")
+		conn.Close()
 	}
 }
 
-//Close stops a running sftp server
+//Close stops a running sftp server right away, the open connections are cut and their in-flight uploads aborted
 func (s *Server) Close() error {
-	s.running = false
-	s.listener.SetDeadline(time.Now())
-	s.wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
 	return nil
 }
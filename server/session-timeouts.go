@@ -0,0 +1,141 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+//DefaultKeepaliveCountMax is the number of unanswered keepalives after which a client is considered dead
+const DefaultKeepaliveCountMax = 3
+
+//activityChannel records when a sftp packet was last read from or written to a session
+type activityChannel struct {
+	ssh.Channel
+	last *int64
+}
+
+func (c *activityChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activityChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+//sessionWatch closes a connection that is idle, has outlived the maximum session duration or stopped
+//answering keepalives. Closing the connection ends its sftp sessions, which abort their in-flight uploads.
+type sessionWatch struct {
+	sconn  *ssh.ServerConn
+	config *Config
+	last   int64
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newSessionWatch(sconn *ssh.ServerConn, config *Config) *sessionWatch {
+	w := &sessionWatch{
+		sconn:  sconn,
+		config: config,
+		last:   time.Now().UnixNano(),
+		done:   make(chan struct{}),
+	}
+	if config.IdleTimeout > 0 {
+		go w.watchIdle()
+	}
+	if config.MaxSessionDuration > 0 {
+		go w.watchDuration()
+	}
+	if config.KeepaliveInterval > 0 {
+		go w.keepalive()
+	}
+	return w
+}
+
+//channel wraps a session channel so its packets count as activity
+func (w *sessionWatch) channel(channel ssh.Channel) ssh.Channel {
+	return &activityChannel{Channel: channel, last: &w.last}
+}
+
+//stop ends the watch once the connection is closed
+func (w *sessionWatch) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *sessionWatch) expire(reason string) {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+	log.WithFields(log.Fields{"user": w.sconn.User(), "addr": w.sconn.RemoteAddr()}).Infof("Closing connection, %v", reason)
+	w.stop()
+	w.sconn.Close()
+}
+
+func (w *sessionWatch) watchIdle() {
+	ticker := time.NewTicker(w.config.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&w.last))) >= w.config.IdleTimeout {
+				w.expire("idle for " + w.config.IdleTimeout.String())
+				return
+			}
+		}
+	}
+}
+
+func (w *sessionWatch) watchDuration() {
+	timer := time.NewTimer(w.config.MaxSessionDuration)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+		w.expire("maximum session duration of " + w.config.MaxSessionDuration.String() + " reached")
+	}
+}
+
+//keepalive sends keepalive@openssh.com requests, which clients answer with a failure
+func (w *sessionWatch) keepalive() {
+	countMax := w.config.KeepaliveCountMax
+	if countMax <= 0 {
+		countMax = DefaultKeepaliveCountMax
+	}
+	ticker := time.NewTicker(w.config.KeepaliveInterval)
+	defer ticker.Stop()
+
+	var missed int32
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		if int(atomic.AddInt32(&missed, 1)) > countMax {
+			w.expire("client stopped answering keepalives")
+			return
+		}
+		go func() {
+			if _, _, err := w.sconn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+				atomic.StoreInt32(&missed, 0)
+			}
+		}()
+	}
+}